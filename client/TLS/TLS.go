@@ -1,9 +1,14 @@
 package TLS
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"github.com/cbeuw/masquerable/client"
-	"time"
+	"github.com/cbeuw/masquerable/drbg"
 )
 
 // AddRecordLayer adds record layer to data
@@ -25,8 +30,20 @@ func PeelRecordLayer(data []byte) []byte {
 }
 
 type browser interface {
-	composeExtensions()
-	composeClientHello()
+	composeExtensions(*client.State) []byte
+	composeClientHello(*client.State, []byte) []byte
+}
+
+// browsers maps the names accepted by client.State.Browser to their implementations
+var browsers = map[string]browser{
+	"chrome":  &chrome{},
+	"firefox": &firefox{},
+}
+
+// IsSupportedBrowser checks if name is a browser whose ClientHello can be composed
+func IsSupportedBrowser(name string) bool {
+	_, ok := browsers[name]
+	return ok
 }
 
 func makeServerName(sta *client.State) []byte {
@@ -46,9 +63,39 @@ func makeServerName(sta *client.State) []byte {
 
 var u32 = binary.BigEndian.Uint32
 
+// makeSessionTicket makes a ticket that stays the same for TicketTimeHint
+// seconds, like one a real server would have given out
 func makeSessionTicket(sta *client.State) []byte {
-	seed := int64(sta.Opaque + int(u32(sta.AESKey)) + int(sta.Now().Unix())/sta.TicketTimeHint)
-	return client.PsudoRandBytes(192, seed)
+	window := make([]byte, 8)
+	binary.BigEndian.PutUint64(window, uint64(sta.Now().Unix()/int64(sta.TicketTimeHint)))
+	opaque := make([]byte, 8)
+	binary.BigEndian.PutUint64(opaque, uint64(sta.Opaque))
+	ticket := make([]byte, 192)
+	drbg.New(sta.Keys.Ticket, window, opaque).Read(ticket)
+	return ticket
+}
+
+var keyShareCurves = map[uint16]ecdh.Curve{
+	0x001d: ecdh.X25519(),
+	0x0017: ecdh.P256(),
+	0x0018: ecdh.P384(),
+}
+
+// makeKeyShare makes the data of a key_share extension with a fresh public key
+// for each of the named groups
+func makeKeyShare(groups ...uint16) []byte {
+	ret := make([]byte, 2)
+	for _, group := range groups {
+		priv, _ := keyShareCurves[group].GenerateKey(rand.Reader)
+		pub := priv.PublicKey().Bytes()
+		entry := make([]byte, 4+len(pub))
+		binary.BigEndian.PutUint16(entry[0:2], group)
+		binary.BigEndian.PutUint16(entry[2:4], uint16(len(pub)))
+		copy(entry[4:], pub)
+		ret = append(ret, entry...)
+	}
+	binary.BigEndian.PutUint16(ret[0:2], uint16(len(ret)-2))
+	return ret
 }
 
 func makeNullBytes(length int) []byte {
@@ -70,18 +117,177 @@ func addExtRec(typ []byte, data []byte) []byte {
 	return ret
 }
 
-// ComposeInitHandshake composes ClientHello with record layer
-func ComposeInitHandshake(sta *client.State) []byte {
-	var ch []byte
-	ch = (&chrome{}).composeClientHello(sta)
+// makePadding makes the padding extension that BoringSSL and NSS add to
+// ClientHellos between 256 and 511 bytes long to bring them up to 512 bytes.
+// unpaddedLen is the length of the handshake message without the padding.
+// It returns nil if no padding is needed
+func makePadding(unpaddedLen int) []byte {
+	if unpaddedLen <= 0xff || unpaddedLen >= 0x200 {
+		return nil
+	}
+	paddingLen := 0x200 - unpaddedLen
+	if paddingLen >= 4+1 {
+		paddingLen -= 4
+	} else {
+		paddingLen = 1
+	}
+	return addExtRec([]byte{0x00, 0x15}, makeNullBytes(paddingLen))
+}
+
+// composeHello puts the fields of a ClientHello together, padding it if needed
+func composeHello(random []byte, sessionId []byte, cipherSuites []byte, extensions []byte) []byte {
+	// Everything before extensions is 4+2+32+1+len(sessionId)+2+len(cipherSuites)+1+1+2 bytes
+	unpaddedLen := 45 + len(sessionId) + len(cipherSuites) + len(extensions)
+	extensions = append(extensions, makePadding(unpaddedLen)...)
+
+	var clientHello [12][]byte
+	clientHello[0] = []byte{0x01}                 // handshake type
+	clientHello[1] = make([]byte, 3)              // length, filled in below
+	clientHello[2] = []byte{0x03, 0x03}           // client version
+	clientHello[3] = random                       // random
+	clientHello[4] = []byte{byte(len(sessionId))} // session id length
+	clientHello[5] = sessionId                    // session id
+	clientHello[6] = make([]byte, 2)              // cipher suites length
+	clientHello[7] = cipherSuites                 // cipher suites
+	clientHello[8] = []byte{0x01}                 // compression methods length 1
+	clientHello[9] = []byte{0x00}                 // compression methods
+	clientHello[10] = make([]byte, 2)             // extensions length
+	clientHello[11] = extensions                  // extensions
+	binary.BigEndian.PutUint16(clientHello[6], uint16(len(cipherSuites)))
+	binary.BigEndian.PutUint16(clientHello[10], uint16(len(extensions)))
+	var ret []byte
+	for i := 0; i < 12; i++ {
+		ret = append(ret, clientHello[i]...)
+	}
+	length := len(ret) - 4
+	ret[1], ret[2], ret[3] = byte(length>>16), byte(length>>8), byte(length)
+	return ret
+}
+
+// ComposeInitHandshake composes ClientHello with record layer. random should
+// be made by client.MakeRandomField
+func ComposeInitHandshake(sta *client.State, random []byte) []byte {
+	b, ok := browsers[sta.Browser]
+	if !ok {
+		b = browsers["chrome"]
+	}
+	ch := b.composeClientHello(sta, random)
 	return AddRecordLayer(ch, []byte{0x16}, []byte{0x03, 0x01})
 }
 
-// ComposeReply composes RL+ChangeCipherSpec+RL+Finished
-func ComposeReply() []byte {
+// IsTLS13ServerHello checks if a ServerHello, with record layer, selects TLS 1.3
+// in its supported_versions extension
+func IsTLS13ServerHello(data []byte) (ret bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ret = false
+		}
+	}()
+	data = PeelRecordLayer(data)
+	// handshake type, length, version and random
+	pointer := 1 + 3 + 2 + 32
+	sessionIdLen := int(data[pointer])
+	pointer += 1 + sessionIdLen
+	// cipher suite and compression method
+	pointer += 2 + 1
+	extensionsLen := int(binary.BigEndian.Uint16(data[pointer : pointer+2]))
+	pointer += 2
+	end := pointer + extensionsLen
+	for pointer < end {
+		typ := binary.BigEndian.Uint16(data[pointer : pointer+2])
+		length := int(binary.BigEndian.Uint16(data[pointer+2 : pointer+4]))
+		pointer += 4
+		if typ == 0x002b {
+			return length == 2 && binary.BigEndian.Uint16(data[pointer:pointer+2]) == 0x0304
+		}
+		pointer += length
+	}
+	return false
+}
+
+// ComposeReply composes RL+ChangeCipherSpec+RL+Finished. In TLS 1.3 the
+// Finished is encrypted so it goes in an application_data record
+func ComposeReply(tls13 bool) []byte {
 	TLS12 := []byte{0x03, 0x03}
 	ccsBytes := AddRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
-	finished := client.PsudoRandBytes(40, time.Now().UnixNano())
-	fBytes := AddRecordLayer(finished, []byte{0x16}, TLS12)
+	var fBytes []byte
+	if tls13 {
+		// 32 bytes verify_data, 4 bytes handshake header, 1 byte content type and 16 bytes tag
+		finished := client.CryptoRandBytes(53)
+		fBytes = AddRecordLayer(finished, []byte{0x17}, TLS12)
+	} else {
+		finished := client.CryptoRandBytes(40)
+		fBytes = AddRecordLayer(finished, []byte{0x16}, TLS12)
+	}
 	return append(ccsBytes, fBytes...)
 }
+
+// FlightLengths reads how many records there are in each of mq-server's
+// flights from the random of serverHello, the first record it sent. Only
+// the first flight is sent before the client's reply.
+//
+// They are in the last two bytes of the random, or in the two before the
+// downgrade sentinel if it ends in one
+func FlightLengths(key []byte, clientRandom []byte, serverHello []byte) (first int, second int, err error) {
+	// record layer, handshake type, length, version and random
+	if len(serverHello) < 5+4+2+32 || serverHello[0] != 0x16 || serverHello[5] != 0x02 {
+		return 0, 0, errors.New("Not a ServerHello")
+	}
+	serverRandom := serverHello[11:43]
+	at := 30
+	// DOWNGRD followed by 0x01 or 0x00, RFC 8446 section 4.1.3
+	if bytes.Equal(serverRandom[24:31], []byte("DOWNGRD")) && serverRandom[31] <= 0x01 {
+		at = 22
+	}
+	h := sha256.New()
+	h.Write(key)
+	h.Write(clientRandom)
+	h.Write(serverRandom[:at])
+	mask := h.Sum(nil)
+	first = int(serverRandom[at] ^ mask[0])
+	second = int(serverRandom[at+1] ^ mask[1])
+	if first == 0 {
+		return 0, 0, errors.New("Bad flight lengths, the key may be wrong")
+	}
+	return first, second, nil
+}
+
+// ComposeKeyExchange composes RL+ClientKeyExchange to answer flight, the
+// records of the first flight of a full TLS 1.2 handshake. The key is for
+// the group chosen in its ServerKeyExchange
+func ComposeKeyExchange(flight []byte) []byte {
+	var handshake []byte
+	for len(flight) >= 5 {
+		length := int(binary.BigEndian.Uint16(flight[3:5]))
+		if len(flight) < 5+length {
+			break
+		}
+		if flight[0] == 0x16 {
+			handshake = append(handshake, flight[5:5+length]...)
+		}
+		flight = flight[5+length:]
+	}
+
+	// Without a ServerKeyExchange it's RSA, with a 2048 bit encrypted premaster secret
+	body := append([]byte{0x01, 0x00}, client.CryptoRandBytes(256)...)
+	for len(handshake) >= 4 {
+		typ := handshake[0]
+		length := int(u32(append([]byte{0x00}, handshake[1:4]...)))
+		if len(handshake) < 4+length {
+			break
+		}
+		// curve type named_curve and the curve
+		if typ == 0x0c && length >= 3 && handshake[4] == 0x03 {
+			curve, ok := keyShareCurves[binary.BigEndian.Uint16(handshake[5:7])]
+			if !ok {
+				curve = ecdh.X25519()
+			}
+			priv, _ := curve.GenerateKey(rand.Reader)
+			pub := priv.PublicKey().Bytes()
+			body = append([]byte{byte(len(pub))}, pub...)
+		}
+		handshake = handshake[4+length:]
+	}
+	message := append([]byte{0x10, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	return AddRecordLayer(message, []byte{0x16}, []byte{0x03, 0x03})
+}
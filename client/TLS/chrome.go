@@ -1,27 +1,39 @@
-// Chrome 64
+// Chrome 64, or Chrome 70 when TLS 1.3 is offered
 
 package TLS
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"github.com/cbeuw/masquerable/client"
-	"math/rand"
-	"time"
 )
 
-type chrome struct {
-	browser
+type chrome struct{}
+
+// see https://tools.ietf.org/html/draft-davidben-tls-grease-01
+// This is exclusive to chrome.
+func makeGREASE() []byte {
+	sixteenth := int(client.CryptoRandBytes(1)[0] % 16)
+	monoGREASE := byte(sixteenth*16 + 0xA)
+	doubleGREASE := []byte{monoGREASE, monoGREASE}
+	return doubleGREASE
+}
+
+// makeGREASEPair gives the GREASE values of the first and the last GREASE
+// extensions. Chrome never uses the same one for both, an extension can't
+// be given twice
+func makeGREASEPair() ([]byte, []byte) {
+	first := makeGREASE()
+	last := makeGREASE()
+	for last[0] == first[0] {
+		last = makeGREASE()
+	}
+	return first, last
 }
 
 func (c *chrome) composeExtensions(sta *client.State) []byte {
-	// see https://tools.ietf.org/html/draft-davidben-tls-grease-01
-	// This is exclusive to chrome.
-	makeGREASE := func() []byte {
-		rand.Seed(time.Now().UnixNano())
-		sixteenth := rand.Intn(16)
-		monoGREASE := byte(sixteenth*16 + 0xA)
-		doubleGREASE := []byte{monoGREASE, monoGREASE}
-		return doubleGREASE
+	if sta.TLS13 {
+		return c.composeExtensions13(sta)
 	}
 
 	makeSupportedGroups := func() []byte {
@@ -33,8 +45,9 @@ func (c *chrome) composeExtensions(sta *client.State) []byte {
 		return ret
 	}
 
-	var ext [14][]byte
-	ext[0] = addExtRec(makeGREASE(), nil)                          // First GREASE
+	firstGREASE, lastGREASE := makeGREASEPair()
+	var ext [13][]byte
+	ext[0] = addExtRec(firstGREASE, nil)                           // First GREASE
 	ext[1] = addExtRec([]byte{0xff, 0x01}, []byte{0x00})           // renegotiation_info
 	ext[2] = addExtRec([]byte{0x00, 0x00}, makeServerName(sta))    // server name indication
 	ext[3] = addExtRec([]byte{0x00, 0x17}, nil)                    // extended_master_secret
@@ -44,37 +57,77 @@ func (c *chrome) composeExtensions(sta *client.State) []byte {
 	ext[6] = addExtRec([]byte{0x00, 0x05}, []byte{0x01, 0x00, 0x00, 0x00, 0x00}) // status request
 	ext[7] = addExtRec([]byte{0x00, 0x12}, nil)                                  // signed cert timestamp
 	APLN, _ := hex.DecodeString("000c02683208687474702f312e31")
-	ext[8] = addExtRec([]byte{0x00, 0x10}, APLN)                            // app layer proto negotiation
-	ext[9] = addExtRec([]byte{0x75, 0x50}, nil)                             // channel id
-	ext[10] = addExtRec([]byte{0x00, 0x0b}, []byte{0x01, 0x00})             // ec point formats
-	ext[11] = addExtRec([]byte{0x00, 0x0a}, makeSupportedGroups())          // supported groups
-	ext[12] = addExtRec(makeGREASE(), []byte{0x00})                         // Last GREASE
-	ext[13] = addExtRec([]byte{0x00, 0x15}, makeNullBytes(110-len(ext[2]))) // padding
+	ext[8] = addExtRec([]byte{0x00, 0x10}, APLN)                   // app layer proto negotiation
+	ext[9] = addExtRec([]byte{0x75, 0x50}, nil)                    // channel id
+	ext[10] = addExtRec([]byte{0x00, 0x0b}, []byte{0x01, 0x00})    // ec point formats
+	ext[11] = addExtRec([]byte{0x00, 0x0a}, makeSupportedGroups()) // supported groups
+	ext[12] = addExtRec(lastGREASE, []byte{0x00})                  // Last GREASE
 	var ret []byte
-	for i := 0; i < 14; i++ {
+	for i := 0; i < 13; i++ {
 		ret = append(ret, ext[i]...)
 	}
 	return ret
 }
 
-func (c *chrome) composeClientHello(sta *client.State) []byte {
-	var clientHello [12][]byte
-	clientHello[0] = []byte{0x01}                                    // handshake type
-	clientHello[1] = []byte{0x00, 0x01, 0xfc}                        // length 508
-	clientHello[2] = []byte{0x03, 0x03}                              // client version
-	clientHello[3] = client.MakeRandomField(sta)                     // random
-	clientHello[4] = []byte{0x20}                                    // session id length 32
-	clientHello[5] = client.PsudoRandBytes(32, sta.Now().UnixNano()) // session id
-	clientHello[6] = []byte{0x00, 0x1c}                              // cipher suites length 28
-	cipherSuites, _ := hex.DecodeString("2a2ac02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a")
-	clientHello[7] = cipherSuites              // cipher suites
-	clientHello[8] = []byte{0x01}              // compression methods length 1
-	clientHello[9] = []byte{0x00}              // compression methods
-	clientHello[10] = []byte{0x01, 0x97}       // extensions length 407
-	clientHello[11] = c.composeExtensions(sta) // extensions
+func (c *chrome) composeExtensions13(sta *client.State) []byte {
+	makeSupportedGroups := func() []byte {
+		ret := []byte{0x00, 0x08}
+		ret = append(ret, makeGREASE()...)
+		return append(ret, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18)
+	}
+
+	makeKeyShareWithGREASE := func() []byte {
+		// A GREASE entry with one byte of key exchange goes before the real one
+		keyShare := makeKeyShare(0x001d)
+		ret := make([]byte, 2)
+		ret = append(ret, makeGREASE()...)
+		ret = append(ret, 0x00, 0x01, 0x00)
+		ret = append(ret, keyShare[2:]...)
+		binary.BigEndian.PutUint16(ret[0:2], uint16(len(ret)-2))
+		return ret
+	}
+
+	makeSupportedVersions := func() []byte {
+		ret := []byte{0x0a}
+		ret = append(ret, makeGREASE()...)
+		return append(ret, 0x03, 0x04, 0x03, 0x03, 0x03, 0x02, 0x03, 0x01)
+	}
+
+	firstGREASE, lastGREASE := makeGREASEPair()
+	var ext [16][]byte
+	ext[0] = addExtRec(firstGREASE, nil)                           // First GREASE
+	ext[1] = addExtRec([]byte{0x00, 0x00}, makeServerName(sta))    // server name indication
+	ext[2] = addExtRec([]byte{0x00, 0x17}, nil)                    // extended_master_secret
+	ext[3] = addExtRec([]byte{0xff, 0x01}, []byte{0x00})           // renegotiation_info
+	ext[4] = addExtRec([]byte{0x00, 0x0a}, makeSupportedGroups())  // supported groups
+	ext[5] = addExtRec([]byte{0x00, 0x0b}, []byte{0x01, 0x00})     // ec point formats
+	ext[6] = addExtRec([]byte{0x00, 0x23}, makeSessionTicket(sta)) // Session tickets
+	APLN, _ := hex.DecodeString("000c02683208687474702f312e31")
+	ext[7] = addExtRec([]byte{0x00, 0x10}, APLN)                                 // app layer proto negotiation
+	ext[8] = addExtRec([]byte{0x00, 0x05}, []byte{0x01, 0x00, 0x00, 0x00, 0x00}) // status request
+	sigAlgo, _ := hex.DecodeString("0012040308040401050308050501080606010201")
+	ext[9] = addExtRec([]byte{0x00, 0x0d}, sigAlgo)                   // Signature Algorithms
+	ext[10] = addExtRec([]byte{0x00, 0x12}, nil)                      // signed cert timestamp
+	ext[11] = addExtRec([]byte{0x00, 0x33}, makeKeyShareWithGREASE()) // key share
+	ext[12] = addExtRec([]byte{0x00, 0x2d}, []byte{0x01, 0x01})       // psk key exchange modes
+	ext[13] = addExtRec([]byte{0x00, 0x2b}, makeSupportedVersions())  // supported versions
+	ext[14] = addExtRec([]byte{0x00, 0x1b}, []byte{0x02, 0x00, 0x02}) // compress certificate
+	ext[15] = addExtRec(lastGREASE, []byte{0x00})                     // Last GREASE
 	var ret []byte
-	for i := 0; i < 12; i++ {
-		ret = append(ret, clientHello[i]...)
+	for i := 0; i < 16; i++ {
+		ret = append(ret, ext[i]...)
 	}
 	return ret
 }
+
+func (c *chrome) composeClientHello(sta *client.State, random []byte) []byte {
+	var cipherSuites []byte
+	if sta.TLS13 {
+		cipherSuites, _ = hex.DecodeString("130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a")
+		cipherSuites = append(makeGREASE(), cipherSuites...)
+	} else {
+		cipherSuites, _ = hex.DecodeString("2a2ac02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a")
+	}
+	sessionId := client.CryptoRandBytes(32)
+	return composeHello(random, sessionId, cipherSuites, c.composeExtensions(sta))
+}
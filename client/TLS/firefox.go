@@ -0,0 +1,50 @@
+// Firefox 65. It always offers TLS 1.3
+
+package TLS
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/cbeuw/masquerable/client"
+)
+
+type firefox struct{}
+
+func (f *firefox) composeExtensions(sta *client.State) []byte {
+	makeSupportedGroups := func() []byte {
+		suppGroupList, _ := hex.DecodeString("001d00170018001901000101")
+		ret := make([]byte, 2+len(suppGroupList))
+		binary.BigEndian.PutUint16(ret[0:2], uint16(len(suppGroupList)))
+		copy(ret[2:], suppGroupList)
+		return ret
+	}
+
+	var ext [13][]byte
+	ext[0] = addExtRec([]byte{0x00, 0x00}, makeServerName(sta))    // server name indication
+	ext[1] = addExtRec([]byte{0x00, 0x17}, nil)                    // extended_master_secret
+	ext[2] = addExtRec([]byte{0xff, 0x01}, []byte{0x00})           // renegotiation_info
+	ext[3] = addExtRec([]byte{0x00, 0x0a}, makeSupportedGroups())  // supported groups
+	ext[4] = addExtRec([]byte{0x00, 0x0b}, []byte{0x01, 0x00})     // ec point formats
+	ext[5] = addExtRec([]byte{0x00, 0x23}, makeSessionTicket(sta)) // Session tickets
+	APLN, _ := hex.DecodeString("000c02683208687474702f312e31")
+	ext[6] = addExtRec([]byte{0x00, 0x10}, APLN)                                                         // app layer proto negotiation
+	ext[7] = addExtRec([]byte{0x00, 0x05}, []byte{0x01, 0x00, 0x00, 0x00, 0x00})                         // status request
+	ext[8] = addExtRec([]byte{0x00, 0x33}, makeKeyShare(0x001d, 0x0017))                                 // key share
+	ext[9] = addExtRec([]byte{0x00, 0x2b}, []byte{0x08, 0x03, 0x04, 0x03, 0x03, 0x03, 0x02, 0x03, 0x01}) // supported versions
+	sigAlgo, _ := hex.DecodeString("001604030503060308040805080604010501060102030201")
+	ext[10] = addExtRec([]byte{0x00, 0x0d}, sigAlgo)            // Signature Algorithms
+	ext[11] = addExtRec([]byte{0x00, 0x2d}, []byte{0x01, 0x01}) // psk key exchange modes
+	ext[12] = addExtRec([]byte{0x00, 0x1c}, []byte{0x40, 0x01}) // record size limit
+	var ret []byte
+	for i := 0; i < 13; i++ {
+		ret = append(ret, ext[i]...)
+	}
+	return ret
+}
+
+func (f *firefox) composeClientHello(sta *client.State, random []byte) []byte {
+	cipherSuites, _ := hex.DecodeString("130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a")
+	sessionId := client.CryptoRandBytes(32)
+	return composeHello(random, sessionId, cipherSuites, f.composeExtensions(sta))
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"github.com/cbeuw/masquerable/internal/dest"
+)
+
+// DefaultAllowedDests are the destinations the proxy tunnels to unless configured otherwise
+var DefaultAllowedDests = []string{"mumble.bravecollective.com:64738", "165.227.66.72:64738"}
+
+// DefaultMutedHosts are hosts that are refused without logging. Mumble checks
+// for updates at mumble.info and users freak out when they see it refused
+var DefaultMutedHosts = []string{"mumble.info"}
+
+// IsAllowed checks if host:port matches one of sta.AllowedDests, see dest.Match
+func (sta *State) IsAllowed(host string, port string) bool {
+	for _, pattern := range sta.AllowedDests {
+		if dest.Match(pattern, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMuted checks if host is one of sta.MutedHosts or a subdomain of one
+func (sta *State) IsMuted(host string) bool {
+	for _, muted := range sta.MutedHosts {
+		if dest.MatchHost(muted, host) || dest.MatchHost("*."+muted, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,8 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
-	"fmt"
+	"encoding/binary"
 	"io"
 )
 
@@ -17,15 +16,18 @@ func encrypt(iv []byte, key []byte, plaintext []byte) []byte {
 	return ciphertext
 }
 
-// MakeRandomField makes the random value that can pass the check at server side
+// MakeRandomField makes the random value that can pass the check at server side.
+// The first 16 bytes are the IV. The rest is the timestamp and its proof,
+// see kdf.Keys.Proof, encrypted with the auth key
 func MakeRandomField(sta *State) []byte {
-	h := sha256.New()
-	t := int(sta.Now().Unix()) / (12 * 60 * 60)
-	h.Write([]byte(fmt.Sprintf("%v", t) + sta.Key))
-	goal := h.Sum(nil)[0:16]
+	timestamp := make([]byte, 4)
+	binary.BigEndian.PutUint32(timestamp, uint32(sta.Now().Unix()))
+	goal := make([]byte, 16)
+	copy(goal, timestamp)
+	copy(goal[4:], sta.Keys.Proof(timestamp))
 	iv := make([]byte, 16)
 	io.ReadFull(rand.Reader, iv)
-	rest := encrypt(iv, sta.AESKey, goal)
+	rest := encrypt(iv, sta.Keys.Auth, goal)
 	ret := make([]byte, 32)
 	copy(ret, iv)
 	copy(ret[16:], rest)
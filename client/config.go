@@ -0,0 +1,203 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/cbeuw/masquerable/internal/config"
+	"github.com/cbeuw/masquerable/internal/dest"
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// KeyEnv is the environment variable the key can be read from, so that it
+// doesn't show up in ps or shell history
+const KeyEnv = "MQ_KEY"
+
+// rawConfig is how the config file looks. Durations are strings like "10s"
+type rawConfig struct {
+	LocalAddr       string
+	SocksAddr       string
+	UDPAddr         string
+	RemoteAddr      string
+	Key             string
+	KeyFile         string
+	ServerName      string
+	Browser         string
+	TLS13           *bool
+	AllowedDests    []string
+	MutedHosts      []string
+	Forwards        []Forward
+	TicketTimeHint  int
+	DialTimeout     string
+	UDPTimeout      string
+	DrainTimeout    string
+	MuxConns        *int
+	KeepAlive       string
+	KDF             string
+	KeySalt         string
+	Padding         string
+	Shaping         string
+	ShapingLatency  string
+	ShapingOverhead *int
+}
+
+// ParseConfig reads a JSON config file into sta. Anything the file leaves
+// out is left as it is. SetKeys must be called afterwards
+func (sta *State) ParseConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw rawConfig
+	// Catch misspelt fields rather than silently ignoring them
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	strs := []struct {
+		value string
+		dst   *string
+	}{
+		{raw.LocalAddr, &sta.LocalAddr},
+		{raw.SocksAddr, &sta.SocksAddr},
+		{raw.UDPAddr, &sta.UDPAddr},
+		{raw.RemoteAddr, &sta.RemoteAddr},
+		{raw.Key, &sta.Key},
+		{raw.ServerName, &sta.ServerName},
+		{raw.Browser, &sta.Browser},
+		{raw.KDF, &sta.KDF},
+		{raw.KeySalt, &sta.KeySalt},
+		{raw.Padding, &sta.Padding},
+		{raw.Shaping, &sta.Shaping},
+	}
+	for _, s := range strs {
+		if s.value != "" {
+			*s.dst = s.value
+		}
+	}
+	if raw.KeyFile != "" {
+		sta.Key, err = config.ReadKeyFile(raw.KeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	if raw.TLS13 != nil {
+		sta.TLS13 = *raw.TLS13
+	}
+	if raw.AllowedDests != nil {
+		sta.AllowedDests = raw.AllowedDests
+	}
+	if raw.MutedHosts != nil {
+		sta.MutedHosts = raw.MutedHosts
+	}
+	if raw.Forwards != nil {
+		sta.Forwards = raw.Forwards
+	}
+	if raw.MuxConns != nil {
+		sta.MuxConns = *raw.MuxConns
+	}
+	if raw.ShapingOverhead != nil {
+		sta.ShapingOverhead = *raw.ShapingOverhead
+	}
+	if raw.TicketTimeHint != 0 {
+		sta.TicketTimeHint = raw.TicketTimeHint
+	}
+	err = config.ParseDuration("DialTimeout", raw.DialTimeout, &sta.DialTimeout)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("UDPTimeout", raw.UDPTimeout, &sta.UDPTimeout)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("DrainTimeout", raw.DrainTimeout, &sta.DrainTimeout)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("KeepAlive", raw.KeepAlive, &sta.KeepAlive)
+	if err != nil {
+		return err
+	}
+	return config.ParseDuration("ShapingLatency", raw.ShapingLatency, &sta.ShapingLatency)
+}
+
+// Validate checks that sta is complete and makes sense
+func (sta *State) Validate() error {
+	addrs := map[string]string{
+		"LocalAddr":  sta.LocalAddr,
+		"RemoteAddr": sta.RemoteAddr,
+	}
+	if sta.SocksAddr != "" {
+		addrs["SocksAddr"] = sta.SocksAddr
+	}
+	if sta.UDPAddr != "" {
+		addrs["UDPAddr"] = sta.UDPAddr
+	}
+	for name, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	if sta.Key == "" {
+		return errors.New("Key must not be empty")
+	}
+	if sta.ServerName == "" {
+		return errors.New("ServerName must not be empty")
+	}
+	// The longest a DNS name can be
+	if len(sta.ServerName) > 253 {
+		return errors.New("ServerName must be at most 253 bytes")
+	}
+	if err := kdf.Check(sta.KDF, sta.KeySalt); err != nil {
+		return err
+	}
+	for _, pattern := range sta.AllowedDests {
+		if err := dest.CheckPattern(pattern); err != nil {
+			return fmt.Errorf("AllowedDests: %v", err)
+		}
+	}
+	for _, fwd := range sta.Forwards {
+		if _, _, err := net.SplitHostPort(fwd.Local); err != nil {
+			return fmt.Errorf("Forwards: %v", err)
+		}
+		if _, _, err := net.SplitHostPort(fwd.Target); err != nil {
+			return fmt.Errorf("Forwards: %v", err)
+		}
+		if len(fwd.Target) > 255 {
+			return fmt.Errorf("Forwards: %v is too long", fwd.Target)
+		}
+	}
+	if sta.TicketTimeHint <= 0 {
+		return errors.New("TicketTimeHint must be positive")
+	}
+	if sta.DialTimeout <= 0 {
+		return errors.New("DialTimeout must be positive")
+	}
+	if sta.UDPTimeout <= 0 {
+		return errors.New("UDPTimeout must be positive")
+	}
+	if sta.DrainTimeout < 0 {
+		return errors.New("DrainTimeout must not be negative")
+	}
+	if sta.MuxConns < 0 {
+		return errors.New("MuxConns must not be negative")
+	}
+	if sta.KeepAlive < 0 {
+		return errors.New("KeepAlive must not be negative")
+	}
+	if _, err := tunnel.ParsePadding(sta.Padding); err != nil {
+		return err
+	}
+	if err := sta.TunnelShaping().Validate(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,29 +1,95 @@
 package client
 
 import (
-	"crypto/sha256"
 	"time"
+
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/tunnel"
 )
 
 type stateManager interface {
 	ParseConfig(string) error
-	SetAESKey(string)
+	Validate() error
+	SetKeys() error
+}
+
+// Forward is a local address whose connections are tunnelled to Target,
+// a host:port mq-server lets the user reach
+type Forward struct {
+	Local  string
+	Target string
 }
 
 // State stores global variables
 type State struct {
+	// LocalAddr is where the HTTP proxy listens
+	LocalAddr string
+	// SocksAddr is where the SOCKS5 proxy listens. Empty to disable
+	SocksAddr string
+	// UDPAddr is where Mumble voice is received. Empty to disable
+	UDPAddr        string
 	RemoteAddr     string
 	Now            func() time.Time
 	Opaque         int
 	Key            string
 	TicketTimeHint int
-	AESKey         []byte
-	ServerName     string
+	// KDF is how Keys are derived from Key, one of the kdf constants
+	KDF string
+	// KeySalt is the mq-server's, Argon2id needs it
+	KeySalt string
+	// Keys are derived from Key by SetKeys
+	Keys       *kdf.Keys
+	ServerName string
+	// Browser is the name of the browser whose ClientHello is mimicked
+	Browser string
+	// TLS13 makes Chrome offer TLS 1.3. Firefox always does
+	TLS13 bool
+	// AllowedDests are the host:port patterns the proxy tunnels to
+	AllowedDests []string
+	// MutedHosts are refused without being logged
+	MutedHosts []string
+	// Forwards are the ports forwarded to targets other than Murmur
+	Forwards []Forward
+	// DialTimeout is how long connecting to mq-server may take
+	DialTimeout time.Duration
+	// UDPTimeout is how long a UDP session is kept without hearing from Mumble
+	UDPTimeout time.Duration
+	// DrainTimeout is how long established connections are given to close
+	// on their own after SIGTERM or SIGINT before they are cut
+	DrainTimeout time.Duration
+	// MuxConns is how many tunnels are shared by all streams. 0 gives every
+	// stream a tunnel of its own
+	MuxConns int
+	// KeepAlive is how often shared tunnels are pinged. One that has been
+	// silent for three times as long is closed
+	KeepAlive time.Duration
+	// Padding is the policy records sent to mq-server are padded with,
+	// see tunnel.ParsePadding
+	Padding string
+	// Shaping is the profile of dummy records sent to mq-server during
+	// silence, see tunnel.Shaping. Empty or "none" disables shaping
+	Shaping string
+	// ShapingLatency is the most a write is held back when shaping
+	ShapingLatency time.Duration
+	// ShapingOverhead is how many bytes of dummy records may be sent a second
+	ShapingOverhead int
+}
+
+// SetKeys derives Keys from Key
+func (sta *State) SetKeys() error {
+	keys, err := kdf.Derive(sta.Key, sta.KDF, sta.KeySalt)
+	if err != nil {
+		return err
+	}
+	sta.Keys = keys
+	return nil
 }
 
-// SetAESKey calculates the SHA256 of the string key
-func (sta *State) SetAESKey() {
-	h := sha256.New()
-	h.Write([]byte(sta.Key))
-	sta.AESKey = h.Sum(nil)
+// TunnelShaping is how the tunnels are shaped
+func (sta *State) TunnelShaping() tunnel.Shaping {
+	return tunnel.Shaping{
+		Profile:     sta.Shaping,
+		Latency:     sta.ShapingLatency,
+		MaxOverhead: sta.ShapingOverhead,
+	}
 }
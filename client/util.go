@@ -1,19 +1,18 @@
 package client
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"io"
-	prand "math/rand"
 	"net"
 	"time"
 )
 
-// PsudoRandBytes returns a byte slice filled with psudorandom bytes generated by the seed
-func PsudoRandBytes(length int, seed int64) []byte {
-	prand.Seed(seed)
+// CryptoRandBytes returns a byte slice filled with bytes from crypto/rand
+func CryptoRandBytes(length int) []byte {
 	ret := make([]byte, length)
-	prand.Read(ret)
+	rand.Read(ret)
 	return ret
 }
 
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// openTarget gives a stream to mq-server that it forwards to target
+func openTarget(sta *client.State, target string) (net.Conn, error) {
+	remote, err := openRemote(sta, tunnel.KindTarget)
+	if err != nil {
+		return nil, err
+	}
+	err = tunnel.WriteTarget(remote, target)
+	if err != nil {
+		remote.Close()
+		return nil, err
+	}
+	return remote, nil
+}
+
+// serveForward tunnels every connection accepted on listener to target,
+// until listener is closed
+func serveForward(listener net.Listener, target string, sta *client.State) {
+	log.Printf("Forwarding %v to %v\n", listener.Addr(), target)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("%v", err)
+			continue
+		}
+		conn = pipes.Track(conn)
+		pipes.Spawn(func() {
+			remote, err := openTarget(sta, target)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			p := pair{
+				conn,
+				remote,
+			}
+			log.Printf("New pipe to %v established\n", target)
+			pipes.Spawn(p.remoteToMc)
+			pipes.Spawn(p.mcToRemote)
+		})
+	}
+}
+
+// parseForwards parses local=target pairs separated by commas
+func parseForwards(list string) ([]client.Forward, error) {
+	var ret []client.Forward
+	for _, item := range splitList(list) {
+		fields := strings.SplitN(item, "=", 2)
+		if len(fields) != 2 {
+			return nil, errors.New("Expecting local=target, got " + item)
+		}
+		ret = append(ret, client.Forward{Local: fields[0], Target: fields[1]})
+	}
+	return ret, nil
+}
@@ -1,23 +1,37 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/cbeuw/masquerable"
 	"github.com/cbeuw/masquerable/client"
 	"github.com/cbeuw/masquerable/client/TLS"
+	"github.com/cbeuw/masquerable/internal/config"
+	"github.com/cbeuw/masquerable/internal/dest"
+	"github.com/cbeuw/masquerable/internal/drain"
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/tunnel"
 )
 
 var version string
 
+// pipes tracks every connection so they can be drained on shutdown
+var pipes = drain.NewTracker()
+
 // mc refers to the Mumble client, remote refers to the proxy server
 
 type pair struct {
@@ -32,16 +46,14 @@ func (p *pair) closePipe() {
 }
 
 func (p *pair) remoteToMc() {
-	buf := make([]byte, 16389)
+	buf := make([]byte, 16384)
 	for {
-		i, err := client.ReadTLS(p.remote, buf)
+		i, err := p.remote.Read(buf)
 		if err != nil {
 			p.closePipe()
 			return
 		}
-		// PeelRecordLayer
-		data := buf[5:i]
-		_, err = p.mc.Write(data)
+		_, err = p.mc.Write(buf[:i])
 		if err != nil {
 			p.closePipe()
 			return
@@ -50,17 +62,14 @@ func (p *pair) remoteToMc() {
 }
 
 func (p *pair) mcToRemote() {
-	buf := make([]byte, 16389)
+	buf := make([]byte, 16384)
 	for {
-		i, err := io.ReadAtLeast(p.mc, buf[5:], 1)
+		i, err := io.ReadAtLeast(p.mc, buf, 1)
 		if err != nil {
 			p.closePipe()
 			return
 		}
-		data := buf[:i+5]
-		data[0], data[1], data[2] = 0x17, 0x03, 0x03
-		binary.BigEndian.PutUint16(data[3:5], uint16(i))
-		_, err = p.remote.Write(data)
+		_, err = p.remote.Write(buf[:i])
 		if err != nil {
 			p.closePipe()
 			return
@@ -68,64 +77,51 @@ func (p *pair) mcToRemote() {
 	}
 }
 
-func handleSequence(w http.ResponseWriter, r *http.Request, sta *client.State) {
-	addr := strings.Split(r.Host, ":")
-	hostname := addr[0]
-	if strings.ToLower(hostname) != "mumble.bravecollective.com" && hostname != "165.227.66.72" {
-		if !strings.Contains(hostname, "mumble.info") {
-			// we mute Mumble version checks so users don't freak out
-			log.Printf("%v not allowed\n", hostname)
-		}
-		http.Error(w, "Hostname not supported", http.StatusServiceUnavailable)
-		return
-	}
-	var port string
-	if len(addr) != 2 {
-		port = "80"
-	} else {
-		port = addr[1]
-	}
-	if port != "64738" {
-		log.Printf("Port %v not allowed\n", port)
-		http.Error(w, "Port not supported", http.StatusServiceUnavailable)
-		return
+// dialRemote connects to mq-server, goes through the fake TLS handshake and
+// tells mq-server what kind of stream the tunnel will carry
+func dialRemote(sta *client.State, kind byte) (*tunnel.Conn, error) {
+	remoteConn, err := net.DialTimeout("tcp", sta.RemoteAddr, sta.DialTimeout)
+	if err != nil {
+		log.Printf("Dialing remote: %v\n", err)
+		return nil, err
 	}
+	remoteConn = pipes.Track(remoteConn)
 
-	remoteConn, err := net.Dial("tcp", sta.RemoteAddr)
+	remote, err := masquerable.Client(remoteConn, sta, kind)
 	if err != nil {
-		log.Printf("Dialing remote: %v\n", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+		log.Println(err)
+		remoteConn.Close()
+		return nil, err
 	}
+	return remote, nil
+}
 
-	clientHello := TLS.ComposeInitHandshake(sta)
+// checkDestination returns an error if hostname:port isn't somewhere the
+// tunnel goes to
+func checkDestination(hostname string, port string, sta *client.State) error {
+	if !sta.IsAllowed(hostname, port) {
+		if !sta.IsMuted(hostname) {
+			log.Printf("%v:%v not allowed\n", hostname, port)
+		}
+		return errors.New("Destination not supported")
+	}
+	return nil
+}
+
+func handleSequence(w http.ResponseWriter, r *http.Request, sta *client.State) {
+	hostname, port, err := dest.Split(r.Host, "80")
 	if err != nil {
-		log.Printf("Connecting to remote: %v\n", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err = remoteConn.Write(clientHello)
+	err = checkDestination(hostname, port, sta)
 	if err != nil {
-		log.Printf("Sending ClientHello: %v\n", err)
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	// Three discarded messages: ServerHello, ChangeCipherSpec and Finished
-	discardBuf := make([]byte, 1024)
-	for c := 0; c < 3; c++ {
-		_, err = client.ReadTLS(remoteConn, discardBuf)
-		if err != nil {
-			log.Printf("Reading discarded message %v: %v\n", c, err)
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
-			return
-		}
-	}
-
-	reply := TLS.ComposeReply()
-	_, err = remoteConn.Write(reply)
+	remote, err := openRemote(sta, tunnel.KindTCP)
 	if err != nil {
-		log.Printf("Sending reply to remote: %v\n", err)
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
@@ -135,34 +131,80 @@ func handleSequence(w http.ResponseWriter, r *http.Request, sta *client.State) {
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		remote.Close()
 		return
 	}
 	mcConn, _, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		remote.Close()
+		return
 	}
 
 	p := pair{
-		mcConn,
-		remoteConn,
+		pipes.Track(mcConn),
+		remote,
 	}
 	log.Println("New Mumble pipe established")
 
-	go p.remoteToMc()
-	go p.mcToRemote()
+	pipes.Spawn(p.remoteToMc)
+	pipes.Spawn(p.mcToRemote)
+}
 
+// splitList splits a comma separated flag, ignoring empty items
+func splitList(list string) []string {
+	var ret []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
 }
 
 func main() {
-	var bindAddr string
+	var localAddr string
 	var remoteAddr string
 	var key string
+	var keyFile string
+	var configPath string
+	var browser string
+	var tls13 bool
+	var udpAddr string
+	var socksAddr string
+	var serverName string
+	var allowedDests string
+	var mutedHosts string
+	var drainTimeout time.Duration
+	var muxConns int
+	var forwards string
+	var padding string
+	var shaping string
+	var kdfName string
+	var keySalt string
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	flag.StringVar(&bindAddr, "l", "127.0.0.1:1081", "localAddr: ip:port of the HTTP proxy for mumble to connect to")
+	flag.StringVar(&configPath, "c", "", "configPath: JSON config file. Flags given on the command line override it")
+	flag.StringVar(&localAddr, "l", "127.0.0.1:1081", "localAddr: ip:port of the HTTP proxy for mumble to connect to")
+	flag.StringVar(&socksAddr, "s", "", "socksAddr: ip:port of the SOCKS5 proxy for mumble to connect to. Leave empty to disable")
+	flag.StringVar(&udpAddr, "u", "", "udpAddr: ip:port to receive Mumble voice over UDP on. Leave empty to disable")
 	flag.StringVar(&remoteAddr, "r", "165.227.66.72:443", "remoteAddr: ip:port of the mq-server")
-	flag.StringVar(&key, "k", "test", "key: same as the key set on mq-server")
+	flag.StringVar(&key, "k", "", "key: same as the key set on mq-server. Can also be set with "+client.KeyEnv+" (default \"test\")")
+	flag.StringVar(&keyFile, "kf", "", "keyFile: file containing the key")
+	flag.StringVar(&kdfName, "kdf", kdf.HKDF, "kdf: how the key is turned into keys, hkdf, argon2id or legacy. mq-server must accept it")
+	flag.StringVar(&keySalt, "salt", "", "keySalt: the salt of the keys, same as on mq-server. argon2id needs it")
+	flag.StringVar(&serverName, "sni", "mumble.braveineve.com", "serverName: hostname to put in the server name indication of ClientHello")
+	flag.StringVar(&allowedDests, "a", strings.Join(client.DefaultAllowedDests, ","), "allowedDests: comma separated host:port patterns to tunnel. host can be *.domain and port can be *")
+	flag.StringVar(&mutedHosts, "mute", strings.Join(client.DefaultMutedHosts, ","), "mutedHosts: comma separated hosts (and their subdomains) to refuse without logging")
+	flag.BoolVar(&tls13, "tls13", false, "tls13: make Chrome offer TLS 1.3. Firefox always does")
+	flag.StringVar(&browser, "browser", "chrome", "browser: whose ClientHello to mimic, chrome or firefox")
+	flag.StringVar(&forwards, "fwd", "", "forwards: comma separated local=target pairs. Connections to ip:port local are tunnelled to host:port target, which must be among the user's targets on mq-server")
+	flag.StringVar(&padding, "pad", tunnel.PadNone, "padding: how records sent to mq-server are padded, none, buckets, fixed, fixed:size or https")
+	flag.StringVar(&shaping, "shape", tunnel.ShapeNone, "shaping: profile of dummy records sent to mq-server during silence, none, browsing or sparse")
+	flag.IntVar(&muxConns, "mux", 0, "muxConns: how many tunnels to share between all Mumble sessions. 0 gives each session its own. mq-server must support it")
+	flag.DurationVar(&drainTimeout, "d", 10*time.Second, "drainTimeout: how long connections are given to close on their own when shutting down")
 	askVersion := flag.Bool("v", false, "Print the version number")
 	printUsage := flag.Bool("h", false, "Print this message")
 	flag.Parse()
@@ -182,24 +224,188 @@ func main() {
 	// opaque is used in the seed to generate SessionTicket
 	opaque := int(binary.BigEndian.Uint32(opaqueB))
 	sta := &client.State{
+		LocalAddr:      localAddr,
+		SocksAddr:      socksAddr,
+		UDPAddr:        udpAddr,
 		RemoteAddr:     remoteAddr,
-		Key:            key,
 		Now:            time.Now,
 		Opaque:         opaque,
 		TicketTimeHint: 3600,
-		ServerName:     "mumble.braveineve.com",
+		ServerName:     serverName,
+		Browser:        browser,
+		TLS13:          tls13,
+		AllowedDests:   splitList(allowedDests),
+		MutedHosts:     splitList(mutedHosts),
+		DialTimeout:    10 * time.Second,
+		UDPTimeout:     2 * time.Minute,
+		DrainTimeout:   drainTimeout,
+		MuxConns:       muxConns,
+		KeepAlive:      30 * time.Second,
+		// Mumble sends voice every 10 to 60ms
+		ShapingLatency:  20 * time.Millisecond,
+		ShapingOverhead: 32768,
+		KDF:             kdf.HKDF,
 	}
 
-	sta.SetAESKey()
+	if configPath != "" {
+		err := sta.ParseConfig(configPath)
+		if err != nil {
+			log.Fatalf("Parsing config: %v\n", err)
+		}
+	}
 
-	log.Printf("Listening for Mumble client on %v\n", bindAddr)
+	// Flags given on the command line override the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "l":
+			sta.LocalAddr = localAddr
+		case "s":
+			sta.SocksAddr = socksAddr
+		case "u":
+			sta.UDPAddr = udpAddr
+		case "r":
+			sta.RemoteAddr = remoteAddr
+		case "sni":
+			sta.ServerName = serverName
+		case "a":
+			sta.AllowedDests = splitList(allowedDests)
+		case "mute":
+			sta.MutedHosts = splitList(mutedHosts)
+		case "tls13":
+			sta.TLS13 = tls13
+		case "browser":
+			sta.Browser = browser
+		case "d":
+			sta.DrainTimeout = drainTimeout
+		case "mux":
+			sta.MuxConns = muxConns
+		case "pad":
+			sta.Padding = padding
+		case "shape":
+			sta.Shaping = shaping
+		case "kdf":
+			sta.KDF = kdfName
+		case "salt":
+			sta.KeySalt = keySalt
+		case "fwd":
+			fwds, err := parseForwards(forwards)
+			if err != nil {
+				log.Fatalf("Invalid -fwd: %v\n", err)
+			}
+			sta.Forwards = fwds
+		}
+	})
+
+	// Where the key comes from, in order: -k, -kf, config file, environment, default
+	switch {
+	case key != "":
+		sta.Key = key
+	case keyFile != "":
+		fileKey, err := config.ReadKeyFile(keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sta.Key = fileKey
+	case sta.Key != "":
+	case os.Getenv(client.KeyEnv) != "":
+		sta.Key = os.Getenv(client.KeyEnv)
+	default:
+		sta.Key = "test"
+	}
+
+	err := sta.Validate()
+	if err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
+	if !TLS.IsSupportedBrowser(sta.Browser) {
+		log.Fatalf("Invalid config: unsupported browser %v\n", sta.Browser)
+	}
+
+	err = sta.SetKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if sta.MuxConns > 0 {
+		pool = newMuxPool(sta)
+	}
+
+	// Everything that listens is closed on shutdown
+	var closers []io.Closer
+
+	if sta.UDPAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", sta.UDPAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		local, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		closers = append(closers, local)
+		pipes.Spawn(func() { serveUDP(local, sta) })
+	}
+
+	if sta.SocksAddr != "" {
+		listener, err := net.Listen("tcp", sta.SocksAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		closers = append(closers, listener)
+		pipes.Spawn(func() { serveSOCKS5(listener, sta) })
+	}
+
+	for _, fwd := range sta.Forwards {
+		listener, err := net.Listen("tcp", fwd.Local)
+		if err != nil {
+			log.Fatal(err)
+		}
+		closers = append(closers, listener)
+		target := fwd.Target
+		pipes.Spawn(func() { serveForward(listener, target, sta) })
+	}
+
+	listener, err := net.Listen("tcp", sta.LocalAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Listening for Mumble client on %v\n", sta.LocalAddr)
 	server := &http.Server{
-		Addr: bindAddr,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			handleSequence(w, r, sta)
 		}),
 	}
-	log.Fatal(server.ListenAndServe())
-	fmt.Println("Press Enter to quit")
-	fmt.Scan()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-stop:
+	}
+	// A second signal kills the process straight away
+	signal.Stop(stop)
+	log.Printf("Shutting down, %v connections open\n", pipes.Count())
+
+	for _, closer := range closers {
+		closer.Close()
+	}
+	// Requests still being handled may yet establish pipes, which are
+	// drained along with the rest
+	ctx, cancel := context.WithTimeout(context.Background(), sta.DrainTimeout)
+	err = server.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		server.Close()
+	}
+
+	left := pipes.Drain(sta.DrainTimeout)
+	if left != 0 {
+		log.Printf("Closed %v connections still open after %v\n", left, sta.DrainTimeout)
+	}
+	log.Println("Shut down")
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/internal/mqserver"
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/server"
+)
+
+// startServer runs mq-server in-process on loopback, with a stand-in for
+// Murmur behind it that echoes back whatever it gets over TCP or UDP. The
+// connections Murmur accepts are passed on through murmurConns
+func startServer(t *testing.T) (addr string, murmurConns chan net.Conn) {
+	murmur, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { murmur.Close() })
+	// Voice goes to the UDP port of the same address
+	voice, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(murmur.Addr().(*net.TCPAddr).AddrPort()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { voice.Close() })
+	murmurConns = make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := murmur.Accept()
+			if err != nil {
+				return
+			}
+			murmurConns <- conn
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			i, from, err := voice.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			voice.WriteToUDP(buf[:i], from)
+		}
+	}()
+
+	sta := &server.State{
+		RedirAddr:           "127.0.0.1:1",
+		BindAddr:            "127.0.0.1:0",
+		MurmurAddr:          murmur.Addr().String(),
+		Now:                 time.Now,
+		Users:               []*server.User{server.NewUser("alice", "correct horse")},
+		KDFs:                []string{kdf.HKDF},
+		MaxSkew:             time.Minute,
+		HandshakeTimeout:    3 * time.Second,
+		DialTimeout:         time.Second,
+		KeepAlive:           time.Minute,
+		HealthCheckInterval: time.Minute,
+	}
+	sta.Replay = server.NewReplayCache(1024, 2*sta.MaxSkew)
+	err = sta.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", sta.BindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := mqserver.Listen(inner, sta)
+	go mqserver.Serve(listener)
+	t.Cleanup(func() { listener.Close() })
+	return inner.Addr().String(), murmurConns
+}
+
+// newClientState is the State of an mq-client connecting to addr
+func newClientState(addr string, muxConns int) *client.State {
+	sta := &client.State{
+		RemoteAddr:     addr,
+		Key:            "correct horse",
+		ServerName:     "www.example.com",
+		Browser:        "chrome",
+		Now:            time.Now,
+		TicketTimeHint: 3600,
+		KDF:            kdf.HKDF,
+		AllowedDests:   []string{"murmur.example.com:64738"},
+		DialTimeout:    time.Second,
+		MuxConns:       muxConns,
+		KeepAlive:      time.Minute,
+		UDPTimeout:     time.Minute,
+	}
+	sta.SetKeys()
+	return sta
+}
+
+// connect makes an HTTP CONNECT to dest through handleSequence, the way
+// Mumble does. It returns the hijacked connection and Murmur's side of
+// each pipe mq-server makes
+func connect(t *testing.T, muxConns int, dest string) (net.Conn, *http.Response, chan net.Conn) {
+	addr, murmurConns := startServer(t)
+	sta := newClientState(addr, muxConns)
+	if muxConns > 0 {
+		pool = newMuxPool(sta)
+		t.Cleanup(func() { pool = nil })
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleSequence(w, r, sta)
+	}))
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("CONNECT " + dest + " HTTP/1.1\r\nHost: " + dest + "\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, resp, murmurConns
+}
+
+func TestConnectGetsTrafficIntact(t *testing.T) {
+	for _, muxConns := range []int{0, 1} {
+		conn, resp, _ := connect(t, muxConns, "murmur.example.com:64738")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("mux %v: CONNECT got %v", muxConns, resp.Status)
+		}
+		sent := make([]byte, 1<<20)
+		rand.Read(sent)
+		go conn.Write(sent)
+		got := make([]byte, len(sent))
+		_, err := io.ReadFull(conn, got)
+		if err != nil {
+			t.Fatalf("mux %v: %v", muxConns, err)
+		}
+		if !bytes.Equal(got, sent) {
+			t.Fatalf("mux %v: echo differs from what was sent", muxConns)
+		}
+	}
+}
+
+func TestConnectRefusesOtherDestinations(t *testing.T) {
+	_, resp, _ := connect(t, 0, "www.example.com:443")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("CONNECT got %v", resp.Status)
+	}
+}
+
+func TestConnectCloseTearsDownPipe(t *testing.T) {
+	for _, mumbleCloses := range []bool{true, false} {
+		conn, resp, murmurConns := connect(t, 0, "murmur.example.com:64738")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT got %v", resp.Status)
+		}
+		ms := <-murmurConns
+		if mumbleCloses {
+			conn.Close()
+			conn = ms
+		} else {
+			ms.Close()
+		}
+		// What's left open sees the other end go away
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.Copy(io.Discard, conn)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("Mumble closing %v: the other end wasn't closed", mumbleCloses)
+		}
+	}
+}
+
+func TestVoiceGetsThrough(t *testing.T) {
+	addr, _ := startServer(t)
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveUDP(local, newClientState(addr, 0))
+	t.Cleanup(func() { local.Close() })
+
+	mumble, err := net.DialUDP("udp", nil, local.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mumble.Close()
+	buf := make([]byte, 65536)
+	for i := 0; i < 5; i++ {
+		sent := make([]byte, 100+i)
+		rand.Read(sent)
+		mumble.Write(sent)
+		mumble.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := mumble.Read(buf)
+		if err != nil {
+			t.Fatalf("Datagram %v: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], sent) {
+			t.Fatalf("Datagram %v: echo differs from what was sent", i)
+		}
+	}
+}
+
+func TestSOCKS5VoiceGetsThrough(t *testing.T) {
+	addr, _ := startServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveSOCKS5(listener, newClientState(addr, 0))
+	t.Cleanup(func() { listener.Close() })
+
+	ctrl, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.SetDeadline(time.Now().Add(5 * time.Second))
+	ctrl.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(ctrl, reply)
+	if err != nil || reply[1] != 0x00 {
+		t.Fatalf("Greeting got %x, %v", reply, err)
+	}
+	// UDP ASSOCIATE, from wherever
+	ctrl.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	reply = make([]byte, 10)
+	_, err = io.ReadFull(ctrl, reply)
+	if err != nil || reply[1] != 0x00 {
+		t.Fatalf("UDP ASSOCIATE got %x, %v", reply, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	mumble, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mumble.Close()
+	// RSV, FRAG, then murmur.example.com:64738
+	header := append([]byte{0x00, 0x00, 0x00, 0x03, byte(len("murmur.example.com"))}, "murmur.example.com"...)
+	header = append(header, 0xfc, 0xe2)
+	buf := make([]byte, 65536)
+	for i := 0; i < 5; i++ {
+		sent := make([]byte, 100+i)
+		rand.Read(sent)
+		mumble.Write(append(append([]byte{}, header...), sent...))
+		mumble.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := mumble.Read(buf)
+		if err != nil {
+			t.Fatalf("Datagram %v: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], append(append([]byte{}, header...), sent...)) {
+			t.Fatalf("Datagram %v: echo differs from what was sent", i)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/mux"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// muxPool keeps up to MuxConns multiplexed tunnels to mq-server and
+// spreads new streams over them in turn
+type muxPool struct {
+	sta      *client.State
+	mutex    sync.Mutex
+	sessions []*mux.Session
+	next     int
+	// dialing is the number of sessions being made. It's done without
+	// holding mutex, so that streams can still be opened on the others
+	dialing int
+	// dialed is signalled when a session is made or fails to be
+	dialed *sync.Cond
+}
+
+func newMuxPool(sta *client.State) *muxPool {
+	pool := &muxPool{sta: sta}
+	pool.dialed = sync.NewCond(&pool.mutex)
+	return pool
+}
+
+// session returns the next session to open a stream on, making a new one
+// if there are fewer than MuxConns
+func (pool *muxPool) session() (*mux.Session, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for {
+		alive := pool.sessions[:0]
+		for _, session := range pool.sessions {
+			if !session.IsClosed() {
+				alive = append(alive, session)
+			}
+		}
+		pool.sessions = alive
+
+		if len(pool.sessions)+pool.dialing < pool.sta.MuxConns {
+			pool.dialing++
+			pool.mutex.Unlock()
+			remote, err := dialRemote(pool.sta, tunnel.KindMux)
+			pool.mutex.Lock()
+			pool.dialing--
+			pool.dialed.Broadcast()
+			if err != nil {
+				return nil, err
+			}
+			session := mux.Client(remote, pool.sta.KeepAlive)
+			pool.sessions = append(pool.sessions, session)
+			log.Printf("New mux session established, %v open\n", len(pool.sessions))
+			return session, nil
+		}
+		if len(pool.sessions) > 0 {
+			pool.next = (pool.next + 1) % len(pool.sessions)
+			return pool.sessions[pool.next], nil
+		}
+		// Every session there can be is still being made
+		pool.dialed.Wait()
+	}
+}
+
+func (pool *muxPool) openStream(kind byte) (net.Conn, error) {
+	for {
+		session, err := pool.session()
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.Open(kind)
+		// The session may have closed since it was picked, try another one
+		if err == mux.ErrSessionClosed {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+}
+
+// pool is set up in main when MuxConns isn't 0
+var pool *muxPool
+
+// openRemote gives a stream of kind to mq-server, either on a tunnel of
+// its own or multiplexed on a shared one
+func openRemote(sta *client.State, kind byte) (net.Conn, error) {
+	if sta.MuxConns > 0 {
+		return pool.openStream(kind)
+	}
+	remote, err := dialRemote(sta, kind)
+	if err != nil {
+		return nil, err
+	}
+	return remote, nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// See RFC 1928
+
+const (
+	socksVersion = 0x05
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSuccess          = 0x00
+	socksRepFailure          = 0x01
+	socksRepNotAllowed       = 0x02
+	socksRepHostUnreachable  = 0x04
+	socksRepCmdNotSupported  = 0x07
+	socksRepAtypNotSupported = 0x08
+)
+
+var errSocksVersion = errors.New("SOCKS5: unsupported version")
+var errSocksNoAuth = errors.New("SOCKS5: client doesn't accept no authentication")
+var errSocksAtyp = errors.New("SOCKS5: unsupported address type")
+
+// readSocksAddr reads ATYP, DST.ADDR and DST.PORT
+func readSocksAddr(r io.Reader) (host string, port string, err error) {
+	atyp := make([]byte, 1)
+	_, err = io.ReadFull(r, atyp)
+	if err != nil {
+		return
+	}
+	var addr []byte
+	switch atyp[0] {
+	case socksAtypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socksAtypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socksAtypDomain:
+		addrLen := make([]byte, 1)
+		_, err = io.ReadFull(r, addrLen)
+		if err != nil {
+			return
+		}
+		addr = make([]byte, addrLen[0])
+	default:
+		err = errSocksAtyp
+		return
+	}
+	_, err = io.ReadFull(r, addr)
+	if err != nil {
+		return
+	}
+	portBytes := make([]byte, 2)
+	_, err = io.ReadFull(r, portBytes)
+	if err != nil {
+		return
+	}
+	if atyp[0] == socksAtypDomain {
+		host = string(addr)
+	} else {
+		host = net.IP(addr).String()
+	}
+	port = strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))
+	return
+}
+
+// makeSocksAddr makes ATYP, BND.ADDR and BND.PORT out of addr
+func makeSocksAddr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	var ret []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		ret = append([]byte{socksAtypIPv4}, ip4...)
+	} else if ip != nil {
+		ret = append([]byte{socksAtypIPv6}, ip.To16()...)
+	} else {
+		ret = []byte{socksAtypIPv4, 0, 0, 0, 0}
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	return append(ret, portBytes...)
+}
+
+func socksReply(conn net.Conn, rep byte, bindAddr net.Addr) error {
+	reply := []byte{socksVersion, rep, 0x00}
+	_, err := conn.Write(append(reply, makeSocksAddr(bindAddr)...))
+	return err
+}
+
+// socksGreet does the method negotiation. Only "no authentication" is supported
+// as the proxy only listens locally
+func socksGreet(conn net.Conn) error {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return errSocksVersion
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return err
+	}
+	for _, method := range methods {
+		if method == 0x00 {
+			_, err = conn.Write([]byte{socksVersion, 0x00})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion, 0xff})
+	return errSocksNoAuth
+}
+
+func handleSOCKS5(conn net.Conn, sta *client.State) {
+	err := socksGreet(conn)
+	if err != nil {
+		log.Printf("SOCKS5 greeting: %v\n", err)
+		conn.Close()
+		return
+	}
+
+	header := make([]byte, 3)
+	_, err = io.ReadFull(conn, header)
+	if err != nil || header[0] != socksVersion {
+		conn.Close()
+		return
+	}
+	host, port, err := readSocksAddr(conn)
+	if err == errSocksAtyp {
+		socksReply(conn, socksRepAtypNotSupported, nil)
+		conn.Close()
+		return
+	} else if err != nil {
+		conn.Close()
+		return
+	}
+
+	switch header[1] {
+	case socksCmdConnect:
+		socksConnect(conn, host, port, sta)
+	case socksCmdUDPAssociate:
+		socksUDPAssociate(conn, sta)
+	default:
+		socksReply(conn, socksRepCmdNotSupported, nil)
+		conn.Close()
+	}
+}
+
+func socksConnect(conn net.Conn, host string, port string, sta *client.State) {
+	err := checkDestination(host, port, sta)
+	if err != nil {
+		socksReply(conn, socksRepNotAllowed, nil)
+		conn.Close()
+		return
+	}
+
+	remote, err := openRemote(sta, tunnel.KindTCP)
+	if err != nil {
+		socksReply(conn, socksRepHostUnreachable, nil)
+		conn.Close()
+		return
+	}
+
+	err = socksReply(conn, socksRepSuccess, conn.LocalAddr())
+	if err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+
+	p := pair{
+		conn,
+		remote,
+	}
+	log.Println("New Mumble pipe established")
+
+	pipes.Spawn(p.remoteToMc)
+	pipes.Spawn(p.mcToRemote)
+}
+
+// socksAssociation relays the UDP datagrams of one UDP ASSOCIATE request.
+// Every datagram goes through a single tunnel to Murmur no matter what
+// destination it is addressed to, as long as the destination is allowed
+type socksAssociation struct {
+	local   *net.UDPConn
+	ctrl    net.Conn
+	sta     *client.State
+	mutex   sync.Mutex
+	mc      *net.UDPAddr
+	dstAddr []byte
+	remote  net.Conn
+	// queue holds datagrams from the Mumble client until they are written to
+	// the tunnel, which is made when the first one arrives
+	queue chan []byte
+	// done is closed when the association is
+	done      chan struct{}
+	dialOnce  sync.Once
+	closeOnce sync.Once
+}
+
+func (assoc *socksAssociation) close() {
+	assoc.closeOnce.Do(func() { close(assoc.done) })
+	assoc.mutex.Lock()
+	if assoc.remote != nil {
+		go assoc.remote.Close()
+	}
+	assoc.mutex.Unlock()
+	go assoc.local.Close()
+	go assoc.ctrl.Close()
+}
+
+func (assoc *socksAssociation) remoteToMc(remote net.Conn) {
+	buf := make([]byte, 65536)
+	for {
+		i, err := tunnel.ReadDatagram(remote, buf)
+		if err != nil {
+			assoc.close()
+			return
+		}
+		assoc.mutex.Lock()
+		// Replies appear to come from where the Mumble client sent to
+		datagram := append([]byte{0x00, 0x00, 0x00}, assoc.dstAddr...)
+		mc := assoc.mc
+		assoc.mutex.Unlock()
+		datagram = append(datagram, buf[:i]...)
+		_, err = assoc.local.WriteToUDP(datagram, mc)
+		if err != nil {
+			assoc.close()
+			return
+		}
+	}
+}
+
+// mcToRemote makes the tunnel of the association and writes the queued
+// datagrams to it until the association is closed. It runs on its own so
+// that the handshake doesn't hold up reading from the Mumble client
+func (assoc *socksAssociation) mcToRemote() {
+	remote, err := openRemote(assoc.sta, tunnel.KindUDP)
+	if err != nil {
+		log.Printf("Making the UDP session of %v: %v\n", assoc.ctrl.RemoteAddr(), err)
+		assoc.close()
+		return
+	}
+	assoc.mutex.Lock()
+	assoc.remote = remote
+	assoc.mutex.Unlock()
+	// close may have missed remote
+	select {
+	case <-assoc.done:
+		remote.Close()
+		return
+	default:
+	}
+	log.Printf("New UDP session for %v established\n", assoc.ctrl.RemoteAddr())
+	pipes.Spawn(func() { assoc.remoteToMc(remote) })
+	for {
+		select {
+		case datagram := <-assoc.queue:
+			err = tunnel.WriteDatagram(remote, datagram)
+			if err != nil {
+				assoc.close()
+				return
+			}
+		case <-assoc.done:
+			return
+		}
+	}
+}
+
+// readMc reads the datagrams of the Mumble client and queues the ones to
+// allowed destinations for mcToRemote, until the association is closed
+func (assoc *socksAssociation) readMc() {
+	mcIP := assoc.ctrl.RemoteAddr().(*net.TCPAddr).IP
+	buf := make([]byte, 65536)
+	for {
+		i, mc, err := assoc.local.ReadFromUDP(buf)
+		if err != nil {
+			assoc.close()
+			return
+		}
+		// Only the client that made the association may use it
+		if !mc.IP.Equal(mcIP) {
+			continue
+		}
+		datagram := buf[:i]
+		// RSV, FRAG. Fragmentation is not supported
+		if len(datagram) < 4 || datagram[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(datagram[3:])
+		host, port, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		if checkDestination(host, port, assoc.sta) != nil {
+			continue
+		}
+		dstAddr := datagram[3 : len(datagram)-r.Len()]
+		data := append([]byte{}, datagram[len(datagram)-r.Len():]...)
+
+		assoc.mutex.Lock()
+		assoc.mc = mc
+		assoc.dstAddr = append([]byte{}, dstAddr...)
+		assoc.mutex.Unlock()
+		assoc.dialOnce.Do(func() { pipes.Spawn(assoc.mcToRemote) })
+		select {
+		case assoc.queue <- data:
+		default:
+		}
+	}
+}
+
+func socksUDPAssociate(conn net.Conn, sta *client.State) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		socksReply(conn, socksRepFailure, nil)
+		conn.Close()
+		return
+	}
+	err = socksReply(conn, socksRepSuccess, local.LocalAddr())
+	if err != nil {
+		local.Close()
+		conn.Close()
+		return
+	}
+
+	assoc := &socksAssociation{
+		local: local,
+		ctrl:  conn,
+		sta:   sta,
+		queue: make(chan []byte, udpQueueLen),
+		done:  make(chan struct{}),
+	}
+	pipes.Spawn(assoc.readMc)
+	// The association ends when the TCP connection that made it closes
+	pipes.Spawn(func() {
+		io.Copy(io.Discard, conn)
+		assoc.close()
+	})
+}
+
+// serveSOCKS5 accepts SOCKS5 CONNECT and UDP ASSOCIATE requests until
+// listener is closed
+func serveSOCKS5(listener net.Listener, sta *client.State) {
+	log.Printf("Listening for SOCKS5 on %v\n", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("%v", err)
+			continue
+		}
+		conn = pipes.Track(conn)
+		pipes.Spawn(func() { handleSOCKS5(conn, sta) })
+	}
+}
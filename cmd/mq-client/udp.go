@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// udpSession carries the voice datagrams of one Mumble client through its own tunnel
+type udpSession struct {
+	mc *net.UDPAddr
+	// queue holds datagrams from the Mumble client until they are written to
+	// the tunnel, which is still being made when the first ones arrive
+	queue chan []byte
+	// done is closed when the session is
+	done       chan struct{}
+	closeOnce  sync.Once
+	lastActive time.Time
+}
+
+// The datagrams a session holds while its tunnel is being made or is slow.
+// Any more are dropped, as they would be on the way
+const udpQueueLen = 64
+
+type udpRelay struct {
+	local    *net.UDPConn
+	sta      *client.State
+	mutex    sync.Mutex
+	sessions map[string]*udpSession
+	// closed is closed when local is
+	closed chan struct{}
+}
+
+func (relay *udpRelay) closeSession(sess *udpSession) {
+	relay.mutex.Lock()
+	if relay.sessions[sess.mc.String()] == sess {
+		delete(relay.sessions, sess.mc.String())
+		log.Printf("UDP session of %v closing\n", sess.mc)
+	}
+	relay.mutex.Unlock()
+	sess.closeOnce.Do(func() { close(sess.done) })
+}
+
+func (relay *udpRelay) remoteToMc(sess *udpSession, remote net.Conn) {
+	buf := make([]byte, 65536)
+	for {
+		i, err := tunnel.ReadDatagram(remote, buf)
+		if err != nil {
+			relay.closeSession(sess)
+			return
+		}
+		_, err = relay.local.WriteToUDP(buf[:i], sess.mc)
+		if err != nil {
+			relay.closeSession(sess)
+			return
+		}
+	}
+}
+
+// mcToRemote makes the tunnel of sess and writes the queued datagrams to it
+// until the session is closed. It runs on its own so that the handshake
+// doesn't hold up the voice of other sessions
+func (relay *udpRelay) mcToRemote(sess *udpSession) {
+	remote, err := openRemote(relay.sta, tunnel.KindUDP)
+	if err != nil {
+		log.Printf("Making the UDP session of %v: %v\n", sess.mc, err)
+		relay.closeSession(sess)
+		return
+	}
+	defer remote.Close()
+	log.Printf("New UDP session for %v established\n", sess.mc)
+	pipes.Spawn(func() { relay.remoteToMc(sess, remote) })
+	for {
+		select {
+		case datagram := <-sess.queue:
+			err = tunnel.WriteDatagram(remote, datagram)
+			if err != nil {
+				relay.closeSession(sess)
+				return
+			}
+		case <-sess.done:
+			return
+		}
+	}
+}
+
+// getSession returns the session of the Mumble client at addr, starting a
+// new one if there isn't one
+func (relay *udpRelay) getSession(addr *net.UDPAddr) *udpSession {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	sess, ok := relay.sessions[addr.String()]
+	if ok {
+		return sess
+	}
+	sess = &udpSession{
+		mc:         addr,
+		queue:      make(chan []byte, udpQueueLen),
+		done:       make(chan struct{}),
+		lastActive: time.Now(),
+	}
+	relay.sessions[addr.String()] = sess
+	pipes.Spawn(func() { relay.mcToRemote(sess) })
+	return sess
+}
+
+func (relay *udpRelay) expireSessions() {
+	ticker := time.NewTicker(relay.sta.UDPTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-relay.closed:
+			return
+		}
+		var idle []*udpSession
+		relay.mutex.Lock()
+		for _, sess := range relay.sessions {
+			if time.Since(sess.lastActive) > relay.sta.UDPTimeout {
+				idle = append(idle, sess)
+			}
+		}
+		relay.mutex.Unlock()
+		for _, sess := range idle {
+			relay.closeSession(sess)
+		}
+	}
+}
+
+// serveUDP receives Mumble voice datagrams on local and relays them
+// to mq-server, which sends them on to Murmur over UDP, until local is closed
+func serveUDP(local *net.UDPConn, sta *client.State) {
+	log.Printf("Listening for Mumble voice on %v\n", local.LocalAddr())
+
+	relay := &udpRelay{
+		local:    local,
+		sta:      sta,
+		sessions: make(map[string]*udpSession),
+		closed:   make(chan struct{}),
+	}
+	defer close(relay.closed)
+	pipes.Spawn(relay.expireSessions)
+
+	buf := make([]byte, 65536)
+	for {
+		i, mcAddr, err := local.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Reading UDP: %v\n", err)
+			continue
+		}
+		sess := relay.getSession(mcAddr)
+		relay.mutex.Lock()
+		sess.lastActive = time.Now()
+		relay.mutex.Unlock()
+		datagram := make([]byte, i)
+		copy(datagram, buf[:i])
+		select {
+		case sess.queue <- datagram:
+		default:
+		}
+	}
+}
@@ -1,198 +1,35 @@
 package main
 
 import (
-	"encoding/binary"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/cbeuw/masquerable/internal/config"
+	"github.com/cbeuw/masquerable/internal/mqserver"
+	"github.com/cbeuw/masquerable/kdf"
 	"github.com/cbeuw/masquerable/server"
+	"github.com/cbeuw/masquerable/tunnel"
 )
 
 var version string
-var verbose bool
 
-type msPair struct {
-	ms     net.Conn
-	remote net.Conn
-}
-
-type webPair struct {
-	webServer net.Conn
-	remote    net.Conn
-}
-
-func (pair *webPair) closePipe() {
-	go pair.webServer.Close()
-	go pair.remote.Close()
-}
-
-func (pair *msPair) closePipe() {
-	go pair.ms.Close()
-	go pair.remote.Close()
-}
-
-func (pair *webPair) serverToRemote() {
-	for {
-		length, err := io.Copy(pair.remote, pair.webServer)
-		if err != nil || length == 0 {
-			pair.closePipe()
-			return
-		}
-	}
-}
-
-func (pair *webPair) remoteToServer() {
-	for {
-		length, err := io.Copy(pair.webServer, pair.remote)
-		if err != nil || length == 0 {
-			pair.closePipe()
-			return
-		}
-	}
-}
-
-func (pair *msPair) remoteToServer() {
-	// 16kb + 5 bytes
-	buf := make([]byte, 16389)
-	for {
-		i, err := server.ReadTLS(pair.remote, buf)
-		if err != nil {
-			pair.closePipe()
-			return
-		}
-		// PeelRecordLayer
-		data := buf[5:i]
-		_, err = pair.ms.Write(data)
-		if err != nil {
-			pair.closePipe()
-			return
-		}
-	}
-}
-
-func (pair *msPair) serverToRemote() {
-	// 16kb + 5 bytes
-	buf := make([]byte, 16389)
-	for {
-		i, err := io.ReadAtLeast(pair.ms, buf[5:], 1)
-		if err != nil {
-			pair.closePipe()
-			return
-		}
-		data := buf[:i+5]
-		data[0], data[1], data[2] = 0x17, 0x03, 0x03
-		binary.BigEndian.PutUint16(data[3:5], uint16(i))
-		_, err = pair.remote.Write(data)
-		if err != nil {
-			pair.closePipe()
-			return
-		}
-	}
-}
-
-func dispatchConnection(conn net.Conn, sta *server.State) {
-	goWeb := func(data []byte) {
-		pair, err := makeWebPipe(conn, sta)
-		if err != nil {
-			log.Printf("Making connection to redirection server: %v\n", err)
-			go conn.Close()
-			return
-		}
-		pair.webServer.Write(data)
-		go pair.remoteToServer()
-		go pair.serverToRemote()
-	}
-	goMs := func() {
-		pair, err := makeMsPipe(conn, sta)
-		if err != nil {
-			log.Printf("Making connection to Murmur: %v\n", err)
-		}
-		go pair.remoteToServer()
-		go pair.serverToRemote()
-	}
-
-	buf := make([]byte, 1500)
-
-	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-	i, err := io.ReadAtLeast(conn, buf, 1)
-	if err != nil {
-		log.Println(err)
-		go conn.Close()
-		return
-	}
-	conn.SetReadDeadline(time.Time{})
-	data := buf[:i]
-	ch, err := server.ParseClientHello(data)
-	if err != nil {
-		if verbose {
-			log.Printf("+1 non masquerable non (or malformed) TLS traffic from %v\n", conn.RemoteAddr())
-		}
-		goWeb(data)
-		return
-	}
-
-	isMq := server.IsMq(ch, sta)
-	if !isMq {
-		if verbose {
-			log.Printf("+1 non masquerable TLS traffic from %v\n", conn.RemoteAddr())
-		}
-		goWeb(data)
-		return
-	}
-
-	reply := server.ComposeReply(ch)
-	_, err = conn.Write(reply)
-	if err != nil {
-		if verbose {
-			log.Printf("Sending TLS handshake reply to %v: %v\n", conn.RemoteAddr(), err)
+// splitList splits a comma separated flag, ignoring empty items
+func splitList(list string) []string {
+	var ret []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
 		}
-		go conn.Close()
-		return
 	}
-
-	// Two discarded messages: ChangeCipherSpec and Finished
-	discardBuf := make([]byte, 1024)
-	for c := 0; c < 2; c++ {
-		_, err = server.ReadTLS(conn, discardBuf)
-		if err != nil {
-			if verbose {
-				log.Printf("Reading discarded message %v from %v: %v\n", c, conn.RemoteAddr(), err)
-			}
-			go conn.Close()
-			return
-		}
-	}
-
-	goMs()
-
-}
-
-func makeWebPipe(remote net.Conn, sta *server.State) (*webPair, error) {
-	conn, err := net.Dial("tcp", sta.RedirAddr)
-	if err != nil {
-		return &webPair{}, err
-	}
-	pair := &webPair{
-		conn,
-		remote,
-	}
-	return pair, nil
-}
-
-func makeMsPipe(remote net.Conn, sta *server.State) (*msPair, error) {
-	conn, err := net.Dial("tcp", sta.MurmurAddr)
-	if err != nil {
-		return &msPair{}, err
-	}
-	pair := &msPair{
-		conn,
-		remote,
-	}
-	return pair, nil
+	return ret
 }
 
 func main() {
@@ -200,14 +37,34 @@ func main() {
 	var murmurAddr string
 	var bindAddr string
 	var key string
+	var keyFile string
+	var usersPath string
+	var configPath string
+	var maxSkew time.Duration
+	var drainTimeout time.Duration
+	var metricsAddr string
+	var padding string
+	var shaping string
+	var kdfs string
+	var keySalt string
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	flag.StringVar(&configPath, "c", "", "configPath: JSON config file. Flags given on the command line override it")
 	flag.StringVar(&redirAddr, "r", "", "redirAddr: ip:port of the web server")
 	flag.StringVar(&murmurAddr, "m", "127.0.0.1:64738", "murmurAddr: ip:port of the murmur server")
 	flag.StringVar(&bindAddr, "b", "0.0.0.0:443", "bindAddr: ip:port to bind and listen")
-	flag.StringVar(&key, "k", "test", "key: client must have the same key")
-	flag.BoolVar(&verbose, "V", false, "verbose: enable verbose logging")
+	flag.StringVar(&key, "k", "", "key: client must have the same key. Can also be set with "+server.KeyEnv+" (default \"test\")")
+	flag.StringVar(&keyFile, "kf", "", "keyFile: file containing the key")
+	flag.StringVar(&kdfs, "kdf", kdf.HKDF+","+kdf.Legacy, "kdfs: comma separated ways clients may derive their keys, hkdf, argon2id or legacy")
+	flag.StringVar(&keySalt, "salt", "", "keySalt: salt of the derived keys, something unique to this server. Clients must have the same. argon2id needs it")
+	flag.StringVar(&usersPath, "u", "", "usersPath: file of name:key lines, one per user. Overrides -k")
+	flag.DurationVar(&maxSkew, "s", 5*time.Minute, "maxSkew: how far the clock of a client may be from the server's")
+	flag.DurationVar(&drainTimeout, "d", 10*time.Second, "drainTimeout: how long connections are given to close on their own when shutting down")
+	flag.StringVar(&metricsAddr, "metrics", "", "metricsAddr: ip:port to serve Prometheus metrics on at /metrics. Leave empty to disable")
+	flag.StringVar(&padding, "pad", tunnel.PadNone, "padding: how records sent to mq-client are padded, none, buckets, fixed, fixed:size or https")
+	flag.StringVar(&shaping, "shape", tunnel.ShapeNone, "shaping: profile of dummy records sent to mq-client during silence, none, browsing or sparse")
+	flag.BoolVar(&mqserver.Verbose, "V", false, "verbose: enable verbose logging")
 	askVersion := flag.Bool("v", false, "Print the version number")
 	printUsage := flag.Bool("h", false, "Print this message")
 	flag.Parse()
@@ -222,31 +79,182 @@ func main() {
 		return
 	}
 
-	if redirAddr == "" {
-		log.Fatal("Must specify redirAddr")
-	}
+	// loadState puts together the flags, the config file and the keys,
+	// deriving them into derived. It is called again on every SIGHUP
+	loadState := func(derived *server.KeyCache) (*server.State, error) {
+		sta := &server.State{
+			BindAddr:         bindAddr,
+			RedirAddr:        redirAddr,
+			MurmurAddr:       murmurAddr,
+			Now:              time.Now,
+			MaxSkew:          maxSkew,
+			HandshakeTimeout: 3 * time.Second,
+			DrainTimeout:     drainTimeout,
+			DialTimeout:      5 * time.Second,
+			KeepAlive:        30 * time.Second,
+			// Checks are a bare TCP connect, cheap enough to do often
+			HealthCheckInterval: 10 * time.Second,
+			CloneInterval:       time.Hour,
+			// Mumble sends voice every 10 to 60ms
+			ShapingLatency:  20 * time.Millisecond,
+			ShapingOverhead: 32768,
+			MetricsAddr:     metricsAddr,
+			Verbose:         mqserver.Verbose,
+			KDFs:            splitList(kdfs),
+			KeySalt:         keySalt,
+		}
+
+		if configPath != "" {
+			err := sta.ParseConfig(configPath)
+			if err != nil {
+				return nil, fmt.Errorf("Parsing config: %v", err)
+			}
+		}
 
-	sta := &server.State{
-		RedirAddr:  redirAddr,
-		MurmurAddr: murmurAddr,
-		Key:        key,
-		Now:        time.Now,
+		// Flags given on the command line override the config file
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "r":
+				sta.RedirAddr = redirAddr
+			case "m":
+				sta.MurmurAddr = murmurAddr
+			case "b":
+				sta.BindAddr = bindAddr
+			case "s":
+				sta.MaxSkew = maxSkew
+			case "d":
+				sta.DrainTimeout = drainTimeout
+			case "metrics":
+				sta.MetricsAddr = metricsAddr
+			case "pad":
+				sta.Padding = padding
+			case "shape":
+				sta.Shaping = shaping
+			case "kdf":
+				sta.KDFs = splitList(kdfs)
+			case "salt":
+				sta.KeySalt = keySalt
+			case "V":
+				sta.Verbose = mqserver.Verbose
+			}
+		})
+
+		// Where the keys come from, in order: -u, -k, -kf, config file, environment, default
+		switch {
+		case usersPath != "":
+			users, err := server.LoadUsers(usersPath)
+			if err != nil {
+				return nil, err
+			}
+			sta.Users = users
+		case key != "":
+			sta.Users = []*server.User{server.NewUser("default", key)}
+		case keyFile != "":
+			fileKey, err := config.ReadKeyFile(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			sta.Users = []*server.User{server.NewUser("default", fileKey)}
+		case len(sta.Users) != 0:
+		case os.Getenv(server.KeyEnv) != "":
+			sta.Users = []*server.User{server.NewUser("default", os.Getenv(server.KeyEnv))}
+		default:
+			sta.Users = []*server.User{server.NewUser("default", "test")}
+		}
+
+		err := sta.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config: %v", err)
+		}
+		// Argon2id takes a while for each user, better now than when they connect
+		sta.DerivedKeys = derived
+		err = sta.DeriveKeys()
+		if err != nil {
+			return nil, err
+		}
+		return sta, nil
 	}
 
-	sta.SetAESKey()
+	sta, err := loadState(server.NewKeyCache())
+	if err != nil {
+		log.Fatal(err)
+	}
+	mqserver.Verbose = sta.Verbose
+	// A timestamp stays acceptable for at most 2*MaxSkew
+	sta.Replay = server.NewReplayCache(65536, 2*sta.MaxSkew)
+	sta.Shapes = &server.Shapes{}
 
-	listener, err := net.Listen("tcp", bindAddr)
-	log.Printf("Listening on %v, Murmur on %v, Web on %v\n", bindAddr, murmurAddr, redirAddr)
+	inner, err := net.Listen("tcp", sta.BindAddr)
+	log.Printf("Listening on %v, Murmur on %v, Web on %v, %v users\n", sta.BindAddr, mqserver.BackendAddrs(sta), sta.RedirAddr, len(sta.Users))
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		conn, err := listener.Accept()
+	// New connections are dispatched with whatever State the listener has.
+	// Pipes that are already established don't look at it again
+	listener := mqserver.Listen(inner, sta)
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			old := listener.State()
+			// Keys derived before the reload are kept for the users that are left
+			sta, err := loadState(old.DerivedKeys)
+			if err != nil {
+				log.Printf("Reloading on SIGHUP, keeping the old config: %v\n", err)
+				continue
+			}
+			if sta.BindAddr != old.BindAddr {
+				log.Printf("Reloading on SIGHUP: BindAddr can't be changed without restarting, still listening on %v\n", old.BindAddr)
+			}
+			if sta.MetricsAddr != old.MetricsAddr {
+				log.Println("Reloading on SIGHUP: MetricsAddr can't be changed without restarting")
+			}
+			if sta.Verbose != mqserver.Verbose {
+				log.Println("Reloading on SIGHUP: Verbose can't be changed without restarting")
+			}
+			// Randoms seen before the reload must stay rejected
+			sta.Replay = old.Replay
+			sta.Replay.SetTTL(2 * sta.MaxSkew)
+			sta.Shapes = old.Shapes
+			listener.SetState(sta)
+			mqserver.ForgetBackends(sta)
+			log.Printf("Reloaded config. Murmur on %v, Web on %v, %v users\n", mqserver.BackendAddrs(sta), sta.RedirAddr, len(sta.Users))
+		}
+	}()
+
+	go mqserver.HealthCheck(listener.State)
+	go mqserver.CloneLoop(listener.State)
+
+	if sta.MetricsAddr != "" {
+		metricsListener, err := net.Listen("tcp", sta.MetricsAddr)
 		if err != nil {
-			log.Printf("%v", err)
-			continue
+			log.Fatal(err)
 		}
-		go dispatchConnection(conn, sta)
+		log.Printf("Serving metrics on %v\n", sta.MetricsAddr)
+		go func() {
+			log.Printf("Serving metrics: %v\n", mqserver.ServeMetrics(metricsListener))
+		}()
 	}
 
+	// On SIGTERM or SIGINT, stop accepting and let established connections
+	// finish for up to DrainTimeout
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+		<-stop
+		// A second signal kills the process straight away
+		signal.Stop(stop)
+		log.Printf("Shutting down, %v connections open\n", mqserver.Pipes.Count())
+		listener.Close()
+	}()
+
+	mqserver.Serve(listener)
+
+	timeout := listener.State().DrainTimeout
+	left := mqserver.Pipes.Drain(timeout)
+	if left != 0 {
+		log.Printf("Closed %v connections still open after %v\n", left, timeout)
+	}
+	log.Println("Shut down")
 }
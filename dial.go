@@ -0,0 +1,175 @@
+// Package masquerable lets Go programs use masquerable tunnels directly,
+// without going through mq-client's proxies or mq-server's Murmur pipes.
+//
+// Dial connects to an mq-server and Listen accepts connections from
+// mq-clients. Either way the net.Conn returned carries plain bytes, the
+// disguise and the sealing of records happen underneath
+package masquerable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/client/TLS"
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// prepare returns a copy of cfg with anything left out filled in
+func prepare(cfg *client.State) (*client.State, error) {
+	sta := *cfg
+	if sta.Now == nil {
+		sta.Now = time.Now
+	}
+	if sta.Browser == "" {
+		sta.Browser = "chrome"
+	}
+	if !TLS.IsSupportedBrowser(sta.Browser) {
+		return nil, fmt.Errorf("Unsupported browser %v", sta.Browser)
+	}
+	if sta.TicketTimeHint == 0 {
+		sta.TicketTimeHint = 3600
+	}
+	if sta.ServerName == "" {
+		return nil, errors.New("ServerName must not be empty")
+	}
+	if sta.KDF == "" {
+		sta.KDF = kdf.HKDF
+	}
+	if sta.Keys == nil {
+		err := sta.SetKeys()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &sta, nil
+}
+
+// Client goes through the disguised handshake on conn, which must be
+// connected to mq-server, and tells mq-server the tunnel carries kind.
+//
+// Of cfg only Key (or Keys), KDF, KeySalt, ServerName, Browser, TLS13,
+// TicketTimeHint, Padding and the shaping fields are used, and all but
+// ServerName and the key have defaults. KDF defaults to kdf.HKDF.
+// Deriving Keys with kdf.Argon2id is slow, so set them once beforehand
+// with SetKeys rather than on every call.
+// conn is not closed if the handshake fails
+func Client(conn net.Conn, cfg *client.State, kind byte) (*tunnel.Conn, error) {
+	sta, err := prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	padding, err := tunnel.ParsePadding(sta.Padding)
+	if err != nil {
+		return nil, err
+	}
+	shaping := sta.TunnelShaping()
+	err = shaping.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	random := client.MakeRandomField(sta)
+	clientHello := TLS.ComposeInitHandshake(sta, random)
+	_, err = conn.Write(clientHello)
+	if err != nil {
+		return nil, fmt.Errorf("Sending ClientHello: %v", err)
+	}
+
+	// Discarded messages, starting with ServerHello. The server random says
+	// how many there are, as they copy the handshake of a real web server
+	discardBuf := make([]byte, 5+16384+256)
+	i, err := client.ReadTLS(conn, discardBuf)
+	if err != nil {
+		return nil, fmt.Errorf("Reading ServerHello: %v", err)
+	}
+	tls13 := TLS.IsTLS13ServerHello(discardBuf[:i])
+	first, second, err := TLS.FlightLengths(sta.Keys.Auth, random, discardBuf[:i])
+	if err != nil {
+		return nil, err
+	}
+	flight := append([]byte{}, discardBuf[:i]...)
+	for c := 1; c < first; c++ {
+		i, err := client.ReadTLS(conn, discardBuf)
+		if err != nil {
+			return nil, fmt.Errorf("Reading discarded message %v: %v", c, err)
+		}
+		flight = append(flight, discardBuf[:i]...)
+	}
+
+	var reply []byte
+	// In a full TLS 1.2 handshake the server waits for our key exchange
+	// before its ChangeCipherSpec and Finished. A second TLS 1.3 flight is
+	// the tickets, which come after our Finished without anything else
+	if second > 0 && !tls13 {
+		reply = TLS.ComposeKeyExchange(flight)
+	}
+	reply = append(reply, TLS.ComposeReply(tls13)...)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, fmt.Errorf("Sending reply to remote: %v", err)
+	}
+	for c := 0; c < second; c++ {
+		_, err := client.ReadTLS(conn, discardBuf)
+		if err != nil {
+			return nil, fmt.Errorf("Reading discarded message %v after reply: %v", c, err)
+		}
+	}
+
+	remote := tunnel.Client(conn, sta.Keys.Payload, random)
+	remote.SetPadding(padding)
+	remote.SetShaping(shaping)
+	err = tunnel.WriteHeader(remote, kind)
+	if err != nil {
+		return nil, fmt.Errorf("Sending stream header to remote: %v", err)
+	}
+	return remote, nil
+}
+
+// Dial connects to the mq-server at addr and returns a connection to Murmur,
+// or to whatever else the mq-server passes TCP tunnels to. cfg is as for Client.
+//
+// ctx limits both connecting and the handshake
+func Dial(ctx context.Context, addr string, cfg *client.State) (net.Conn, error) {
+	return dial(ctx, addr, cfg, tunnel.KindTCP, "")
+}
+
+// DialTarget is like Dial but asks the mq-server to forward the connection
+// to target, a host:port the user is allowed to reach
+func DialTarget(ctx context.Context, addr string, cfg *client.State, target string) (net.Conn, error) {
+	return dial(ctx, addr, cfg, tunnel.KindTarget, target)
+}
+
+func dial(ctx context.Context, addr string, cfg *client.State, kind byte, target string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancelling ctx interrupts the handshake
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	remote, err := Client(conn, cfg, kind)
+	if err == nil && kind == tunnel.KindTarget {
+		err = tunnel.WriteTarget(remote, target)
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return remote, nil
+}
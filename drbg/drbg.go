@@ -0,0 +1,80 @@
+// Package drbg is HMAC_DRBG with SHA-256 from NIST SP 800-90A, for the
+// handshake material that has to be the same every time it's made from the
+// same inputs, such as the session ticket. Anything that only has to look
+// random should come from crypto/rand instead
+package drbg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+)
+
+// maxRequest is the most bytes SP 800-90A allows in one generate call.
+// Longer reads are split
+const maxRequest = 1 << 16
+
+// DRBG is a deterministic random bit generator. It's safe for concurrent use,
+// though what each reader gets then depends on the order of the reads
+type DRBG struct {
+	mutex sync.Mutex
+	key   []byte
+	v     []byte
+}
+
+// New instantiates a DRBG from entropy, nonce and personalization. The same
+// inputs always give the same output
+func New(entropy, nonce, personalization []byte) *DRBG {
+	d := &DRBG{
+		key: make([]byte, sha256.Size),
+		v:   make([]byte, sha256.Size),
+	}
+	for i := range d.v {
+		d.v[i] = 0x01
+	}
+	d.update(entropy, nonce, personalization)
+	return d
+}
+
+func (d *DRBG) mac(data ...[]byte) []byte {
+	h := hmac.New(sha256.New, d.key)
+	for _, b := range data {
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// update is HMAC_DRBG_Update, with the provided data given in pieces
+func (d *DRBG) update(provided ...[]byte) {
+	empty := true
+	for _, b := range provided {
+		if len(b) != 0 {
+			empty = false
+		}
+	}
+	d.key = d.mac(append([][]byte{d.v, {0x00}}, provided...)...)
+	d.v = d.mac(d.v)
+	if empty {
+		return
+	}
+	d.key = d.mac(append([][]byte{d.v, {0x01}}, provided...)...)
+	d.v = d.mac(d.v)
+}
+
+// Read fills p with the next len(p) bytes. It never fails
+func (d *DRBG) Read(p []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for done := 0; done < len(p); {
+		end := done + maxRequest
+		if end > len(p) {
+			end = len(p)
+		}
+		for done < end {
+			d.v = d.mac(d.v)
+			done += copy(p[done:end], d.v)
+		}
+		d.update()
+	}
+	return len(p), nil
+}
@@ -0,0 +1,37 @@
+// Package config has what the config parsers of mq-client and mq-server share
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ReadKeyFile reads a key from a file, ignoring surrounding whitespace
+func ReadKeyFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(content))
+	if key == "" {
+		return "", errors.New(path + ": empty key")
+	}
+	return key, nil
+}
+
+// ParseDuration parses value into dst. An empty value leaves dst as it is.
+// name is the field the value is from, for the error
+func ParseDuration(name string, value string, dst *time.Duration) error {
+	if value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	*dst = d
+	return nil
+}
@@ -0,0 +1,56 @@
+// Package dest matches destinations against the host:port patterns that
+// mq-client and mq-server are configured with, so that both ends read them
+// the same way
+package dest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MatchHost matches a hostname against a pattern. The pattern can start with
+// *. to match any subdomain, and * alone matches any host
+func MatchHost(pattern string, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if pattern == "*" || pattern == host {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return false
+}
+
+// Match matches host and port against a host:port pattern, where host is
+// matched by MatchHost and port can be * to match any port. IPv6 hosts are
+// in brackets in the pattern, like [::1]:64738, and without them in host
+func Match(pattern string, host string, port string) bool {
+	patternHost, patternPort, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return false
+	}
+	return MatchHost(patternHost, host) && (patternPort == "*" || patternPort == port)
+}
+
+// CheckPattern returns an error if pattern isn't host:port
+func CheckPattern(pattern string) error {
+	if _, _, err := net.SplitHostPort(pattern); err != nil {
+		return fmt.Errorf("%v is not host:port", pattern)
+	}
+	return nil
+}
+
+// Split splits addr into host and port, the port being defaultPort if addr
+// has none
+func Split(addr string, defaultPort string) (host string, port string, err error) {
+	host, port, err = net.SplitHostPort(addr)
+	if err == nil {
+		return host, port, nil
+	}
+	if addrErr, ok := err.(*net.AddrError); ok && addrErr.Err == "missing port in address" {
+		return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), defaultPort, nil
+	}
+	return "", "", err
+}
@@ -0,0 +1,50 @@
+package dest
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		port    string
+		want    bool
+	}{
+		{"*.example.com:443", "www.example.com", "443", true},
+		{"*.example.com:443", "example.com", "443", false},
+		{"*.example.com:443", "www.example.com", "80", false},
+		{"mumble.example.org:*", "MUMBLE.EXAMPLE.ORG", "64738", true},
+		{"[::1]:64738", "::1", "64738", true},
+		{"[::1]:64738", "::1", "64739", false},
+		{"[::1]:*", "::1", "1", true},
+		// Not host:port, so matches nothing
+		{"::1:64738", "::1", "64738", false},
+		{"noport.example.net", "noport.example.net", "443", false},
+		{"*:*", "anything", "1", true},
+	}
+	for _, c := range cases {
+		if got := Match(c.pattern, c.host, c.port); got != c.want {
+			t.Errorf("Match(%q, %q, %q) = %v, want %v", c.pattern, c.host, c.port, got, c.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		addr string
+		host string
+		port string
+		err  bool
+	}{
+		{"mumble.example.com:64738", "mumble.example.com", "64738", false},
+		{"mumble.example.com", "mumble.example.com", "80", false},
+		{"[::1]:64738", "::1", "64738", false},
+		{"[::1]", "::1", "80", false},
+		{"::1:64738", "", "", true},
+	}
+	for _, c := range cases {
+		host, port, err := Split(c.addr, "80")
+		if c.err != (err != nil) || host != c.host || port != c.port {
+			t.Errorf("Split(%q) = %q, %q, %v", c.addr, host, port, err)
+		}
+	}
+}
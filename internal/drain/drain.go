@@ -0,0 +1,96 @@
+// Package drain lets mq-client and mq-server finish serving their
+// connections before they exit
+package drain
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Tracker keeps account of the live connections and of the goroutines
+// serving them, so that they can be drained on shutdown
+type Tracker struct {
+	mutex sync.Mutex
+	conns map[*trackedConn]struct{}
+	wg    sync.WaitGroup
+}
+
+// trackedConn forgets itself from its tracker when closed
+type trackedConn struct {
+	net.Conn
+	tracker *Tracker
+}
+
+func (conn *trackedConn) Close() error {
+	conn.tracker.mutex.Lock()
+	delete(conn.tracker.conns, conn)
+	conn.tracker.mutex.Unlock()
+	return conn.Conn.Close()
+}
+
+// NewTracker returns an empty Tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		conns: make(map[*trackedConn]struct{}),
+	}
+}
+
+// Track returns conn wrapped so that it is closed by Drain unless it has
+// been closed already
+func (t *Tracker) Track(conn net.Conn) net.Conn {
+	tc := &trackedConn{conn, t}
+	t.mutex.Lock()
+	t.conns[tc] = struct{}{}
+	t.mutex.Unlock()
+	return tc
+}
+
+// Spawn runs f in a goroutine that Drain waits for
+func (t *Tracker) Spawn(f func()) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		f()
+	}()
+}
+
+// Count is the number of connections that are open
+func (t *Tracker) Count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns)
+}
+
+func (t *Tracker) closeAll() {
+	t.mutex.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mutex.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Drain waits up to timeout for the spawned goroutines to finish on their own,
+// then closes whatever connections are left and waits for the goroutines to
+// notice. It returns the number of connections that had to be closed.
+// Nothing may be spawned after Drain is called
+func (t *Tracker) Drain(timeout time.Duration) int {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+	}
+	left := t.Count()
+	t.closeAll()
+	<-done
+	return left
+}
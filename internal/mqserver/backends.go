@@ -0,0 +1,193 @@
+package mqserver
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/masquerable/server"
+)
+
+// backendPool keeps track of which Murmur backends are up and chooses
+// between them
+type backendPool struct {
+	mutex sync.Mutex
+	// down holds the names of the backends that failed their last health
+	// check or dial
+	down map[string]bool
+	// known holds the names of the backends that have been marked, so that
+	// they can be forgotten once they are no longer configured
+	known map[string]bool
+	// voice is the address each user's latest Murmur pipe went to, so that
+	// their voice datagrams go to the same server
+	voice map[string]string
+	// next turns round robin
+	next uint64
+}
+
+func newBackendPool() *backendPool {
+	return &backendPool{
+		down:  make(map[string]bool),
+		known: make(map[string]bool),
+		voice: make(map[string]string),
+	}
+}
+
+var backends = newBackendPool()
+
+// candidates orders the backends of tiers in which they should be tried:
+// those that are up before those that are down, tier by tier, and within
+// a tier starting from the next one in turn
+func (pool *backendPool) candidates(tiers [][]*server.Backend) []*server.Backend {
+	n := int(atomic.AddUint64(&pool.next, 1) % 1024)
+	var up, down []*server.Backend
+	pool.mutex.Lock()
+	for _, tier := range tiers {
+		for i := range tier {
+			backend := tier[(n+i)%len(tier)]
+			if pool.down[backend.Name] {
+				down = append(down, backend)
+			} else {
+				up = append(up, backend)
+			}
+		}
+	}
+	pool.mutex.Unlock()
+	return append(up, down...)
+}
+
+// mark records whether backend could be connected to, logging when that changes
+func (pool *backendPool) mark(backend *server.Backend, err error) {
+	pool.mutex.Lock()
+	wasDown := pool.down[backend.Name]
+	pool.known[backend.Name] = true
+	if err == nil {
+		delete(pool.down, backend.Name)
+	} else {
+		pool.down[backend.Name] = true
+	}
+	pool.mutex.Unlock()
+
+	if err == nil {
+		metrics.backendUp.with(backend.Name).set(1)
+		if wasDown {
+			log.Printf("Backend %v at %v is back up\n", backend.Name, backend.Addr)
+		}
+	} else {
+		metrics.backendUp.with(backend.Name).set(0)
+		if !wasDown {
+			log.Printf("Backend %v at %v is down: %v\n", backend.Name, backend.Addr, err)
+		}
+	}
+}
+
+// forget drops what is known about the backends that sta no longer has,
+// including their mq_backend_up series
+func (pool *backendPool) forget(sta *server.State) {
+	current := make(map[string]bool)
+	for _, backend := range sta.AllBackends() {
+		current[backend.Name] = true
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for name := range pool.known {
+		if !current[name] {
+			delete(pool.known, name)
+			delete(pool.down, name)
+			metrics.backendUp.remove(name)
+		}
+	}
+}
+
+// dialMurmur connects to a backend for a tunnel of user that asked for
+// serverName. Backends that can't be reached are marked down and the next
+// one is tried
+func (pool *backendPool) dialMurmur(sta *server.State, user *server.User, serverName string) (net.Conn, error) {
+	candidates := pool.candidates(sta.Route(user, serverName))
+	if len(candidates) == 0 {
+		return nil, errors.New("No backend for " + user.Name)
+	}
+	var err error
+	for _, backend := range candidates {
+		var conn net.Conn
+		conn, err = dial("tcp", backend.Addr, "murmur", sta.DialTimeout)
+		pool.mark(backend, err)
+		if err != nil {
+			continue
+		}
+		pool.mutex.Lock()
+		pool.voice[user.Name] = backend.Addr
+		pool.mutex.Unlock()
+		return conn, nil
+	}
+	return nil, err
+}
+
+// voiceAddr returns where the voice datagrams of user should go: the backend
+// of their latest Murmur pipe if it's still on their route, otherwise the
+// first candidate
+func (pool *backendPool) voiceAddr(sta *server.State, user *server.User, serverName string) (string, error) {
+	candidates := pool.candidates(sta.Route(user, serverName))
+	if len(candidates) == 0 {
+		return "", errors.New("No backend for " + user.Name)
+	}
+	pool.mutex.Lock()
+	addr, ok := pool.voice[user.Name]
+	pool.mutex.Unlock()
+	if ok {
+		for _, backend := range candidates {
+			if backend.Addr == addr {
+				return addr, nil
+			}
+		}
+	}
+	return candidates[0].Addr, nil
+}
+
+// healthCheck connects to every backend of the current State once every
+// HealthCheckInterval. It never returns
+func (pool *backendPool) healthCheck(state func() *server.State) {
+	for {
+		sta := state()
+		pool.forget(sta)
+		var wg sync.WaitGroup
+		for _, backend := range sta.AllBackends() {
+			wg.Add(1)
+			go func(backend *server.Backend) {
+				defer wg.Done()
+				conn, err := net.DialTimeout("tcp", backend.Addr, sta.DialTimeout)
+				if err == nil {
+					conn.Close()
+				}
+				pool.mark(backend, err)
+			}(backend)
+		}
+		wg.Wait()
+		time.Sleep(sta.HealthCheckInterval)
+	}
+}
+
+// HealthCheck connects to every backend of the current State once every
+// HealthCheckInterval. It never returns
+func HealthCheck(state func() *server.State) {
+	backends.healthCheck(state)
+}
+
+// ForgetBackends drops what is known about the backends that sta no
+// longer has. It is called when sta replaces the State being served
+func ForgetBackends(sta *server.State) {
+	backends.forget(sta)
+}
+
+// BackendAddrs lists the addresses of the backends for logging
+func BackendAddrs(sta *server.State) string {
+	var addrs []string
+	for _, backend := range sta.AllBackends() {
+		addrs = append(addrs, backend.Addr)
+	}
+	return strings.Join(addrs, ", ")
+}
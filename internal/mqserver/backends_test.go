@@ -0,0 +1,131 @@
+package mqserver
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cbeuw/masquerable/server"
+)
+
+var errDown = errors.New("down")
+
+func backendNames(backends []*server.Backend) string {
+	var names []string
+	for _, backend := range backends {
+		names = append(names, backend.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestCandidates(t *testing.T) {
+	pool := newBackendPool()
+	a := &server.Backend{Name: "cand-a", Addr: "127.0.0.1:1"}
+	b := &server.Backend{Name: "cand-b", Addr: "127.0.0.1:2"}
+	c := &server.Backend{Name: "cand-c", Addr: "127.0.0.1:3"}
+	tiers := [][]*server.Backend{{a, b}, {c}}
+
+	// Round robin within a tier, tiers in order
+	first := backendNames(pool.candidates(tiers))
+	second := backendNames(pool.candidates(tiers))
+	if first == second {
+		t.Fatalf("Candidates didn't turn: %v then %v", first, second)
+	}
+	for _, got := range []string{first, second} {
+		if got != "cand-a,cand-b,cand-c" && got != "cand-b,cand-a,cand-c" {
+			t.Fatalf("Candidates out of tier order: %v", got)
+		}
+	}
+
+	// Down backends go last, whatever their tier
+	pool.mark(b, errDown)
+	pool.mark(a, errDown)
+	if got := backendNames(pool.candidates(tiers)); got != "cand-c,cand-a,cand-b" && got != "cand-c,cand-b,cand-a" {
+		t.Fatalf("Candidates with the first tier down: %v", got)
+	}
+	pool.mark(a, nil)
+	if got := backendNames(pool.candidates(tiers)); got != "cand-a,cand-c,cand-b" {
+		t.Fatalf("Candidates after cand-a came back: %v", got)
+	}
+}
+
+func TestCandidatesSharedAddr(t *testing.T) {
+	pool := newBackendPool()
+	// Two names for the same Murmur, only one of which failed
+	a := &server.Backend{Name: "shared-a", Addr: "127.0.0.1:1"}
+	b := &server.Backend{Name: "shared-b", Addr: "127.0.0.1:1"}
+	pool.mark(a, errDown)
+	pool.mark(b, nil)
+	if got := backendNames(pool.candidates([][]*server.Backend{{a, b}})); got != "shared-b,shared-a" {
+		t.Fatalf("Candidates = %v, shared-a is the one down", got)
+	}
+}
+
+func TestVoiceAddr(t *testing.T) {
+	pool := newBackendPool()
+	sta := &server.State{
+		Backends: []*server.Backend{
+			{Name: "voice-1", Addr: "127.0.0.1:1"},
+			{Name: "voice-2", Addr: "127.0.0.1:2"},
+			{Name: "voice-alice", Addr: "127.0.0.1:3", Users: []string{"alice"}},
+		},
+	}
+	alice := &server.User{Name: "alice"}
+	bob := &server.User{Name: "bob"}
+
+	// Voice follows the latest Murmur pipe
+	pool.voice["bob"] = "127.0.0.1:2"
+	for i := 0; i < 4; i++ {
+		addr, err := pool.voiceAddr(sta, bob, "")
+		if err != nil || addr != "127.0.0.1:2" {
+			t.Fatalf("voiceAddr = %v, %v, bob's pipe went to 127.0.0.1:2", addr, err)
+		}
+	}
+	// Not when that backend is no longer on the route
+	pool.voice["bob"] = "127.0.0.1:3"
+	addr, err := pool.voiceAddr(sta, bob, "")
+	if err != nil || (addr != "127.0.0.1:1" && addr != "127.0.0.1:2") {
+		t.Fatalf("voiceAddr = %v, %v, off bob's route", addr, err)
+	}
+	// Without a pipe yet, the first candidate
+	addr, err = pool.voiceAddr(sta, alice, "")
+	if err != nil || addr != "127.0.0.1:3" {
+		t.Fatalf("voiceAddr = %v, %v for alice", addr, err)
+	}
+
+	sta.Backends = sta.Backends[2:]
+	if _, err := pool.voiceAddr(sta, bob, ""); err == nil {
+		t.Fatal("voiceAddr found a backend for bob where there is none")
+	}
+}
+
+func TestForgetRemovedBackends(t *testing.T) {
+	pool := newBackendPool()
+	kept := &server.Backend{Name: "forget-kept", Addr: "127.0.0.1:1"}
+	removed := &server.Backend{Name: "forget-removed", Addr: "127.0.0.1:2"}
+	pool.mark(kept, nil)
+	pool.mark(removed, errDown)
+
+	exported := func() string {
+		w := httptest.NewRecorder()
+		metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	if !strings.Contains(exported(), `"forget-removed"`) {
+		t.Fatal("Backend's mq_backend_up isn't exported")
+	}
+
+	// A reload took forget-removed out
+	pool.forget(&server.State{Backends: []*server.Backend{kept}})
+	body := exported()
+	if strings.Contains(body, `"forget-removed"`) {
+		t.Error("Removed backend's mq_backend_up is still exported")
+	}
+	if !strings.Contains(body, `"forget-kept"`) {
+		t.Error("Kept backend's mq_backend_up is gone")
+	}
+	if pool.down["forget-removed"] {
+		t.Error("Removed backend is still down")
+	}
+}
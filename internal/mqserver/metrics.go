@@ -0,0 +1,270 @@
+package mqserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are served in the Prometheus text format. There are few enough
+// of them that the Prometheus client library isn't worth depending on
+
+type metric interface {
+	// write writes the samples of the metric. labels are name, value pairs
+	write(w io.Writer, name string, labels []string)
+}
+
+type counter struct {
+	value uint64
+}
+
+func (c *counter) add(n uint64) { atomic.AddUint64(&c.value, n) }
+func (c *counter) inc()         { c.add(1) }
+
+func (c *counter) write(w io.Writer, name string, labels []string) {
+	fmt.Fprintf(w, "%v%v %v\n", name, formatLabels(labels), atomic.LoadUint64(&c.value))
+}
+
+type gauge struct {
+	value int64
+}
+
+func (g *gauge) inc()        { atomic.AddInt64(&g.value, 1) }
+func (g *gauge) dec()        { atomic.AddInt64(&g.value, -1) }
+func (g *gauge) set(v int64) { atomic.StoreInt64(&g.value, v) }
+
+func (g *gauge) write(w io.Writer, name string, labels []string) {
+	fmt.Fprintf(w, "%v%v %v\n", name, formatLabels(labels), atomic.LoadInt64(&g.value))
+}
+
+// dialBuckets are the upper bounds, in seconds, of the dial latency histograms
+var dialBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name string, labels []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%v_bucket%v %v\n", name, formatLabels(append(labels, "le", le)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%v_bucket%v %v\n", name, formatLabels(append(labels, "le", "+Inf")), h.count)
+	fmt.Fprintf(w, "%v_sum%v %v\n", name, formatLabels(labels), h.sum)
+	fmt.Fprintf(w, "%v_count%v %v\n", name, formatLabels(labels), h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels turns name, value, name, value... into {name="value",...}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// family is a metric together with all of its label values
+type family struct {
+	name      string
+	help      string
+	kind      string
+	labels    []string
+	newMetric func() metric
+	mutex     sync.Mutex
+	series    map[string]metric
+	values    map[string][]string
+}
+
+func newFamily(name, help, kind string, newMetric func() metric, labels ...string) *family {
+	return &family{
+		name:      name,
+		help:      help,
+		kind:      kind,
+		labels:    labels,
+		newMetric: newMetric,
+		series:    make(map[string]metric),
+		values:    make(map[string][]string),
+	}
+}
+
+// with returns the metric for the label values, making it on first use
+func (f *family) with(values ...string) metric {
+	key := strings.Join(values, "\xff")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	m, ok := f.series[key]
+	if !ok {
+		m = f.newMetric()
+		f.series[key] = m
+		f.values[key] = values
+	}
+	return m
+}
+
+// remove drops the metric for the label values, so that it's no longer
+// exported
+func (f *family) remove(values ...string) {
+	key := strings.Join(values, "\xff")
+	f.mutex.Lock()
+	delete(f.series, key)
+	delete(f.values, key)
+	f.mutex.Unlock()
+}
+
+func (f *family) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", f.name, f.kind)
+	f.mutex.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := make([]string, 0, 2*len(f.labels))
+		for i, name := range f.labels {
+			labels = append(labels, name, f.values[key][i])
+		}
+		f.series[key].write(w, f.name, labels)
+	}
+	f.mutex.Unlock()
+}
+
+type counterVec struct{ *family }
+
+func newCounterVec(name, help string, labels ...string) counterVec {
+	return counterVec{newFamily(name, help, "counter", func() metric { return &counter{} }, labels...)}
+}
+
+func (v counterVec) with(values ...string) *counter { return v.family.with(values...).(*counter) }
+
+type gaugeVec struct{ *family }
+
+func newGaugeVec(name, help string, labels ...string) gaugeVec {
+	return gaugeVec{newFamily(name, help, "gauge", func() metric { return &gauge{} }, labels...)}
+}
+
+func (v gaugeVec) with(values ...string) *gauge { return v.family.with(values...).(*gauge) }
+
+type histogramVec struct{ *family }
+
+func newHistogramVec(name, help string, bounds []float64, labels ...string) histogramVec {
+	return histogramVec{newFamily(name, help, "histogram", func() metric { return newHistogram(bounds) }, labels...)}
+}
+
+func (v histogramVec) with(values ...string) *histogram { return v.family.with(values...).(*histogram) }
+
+// serverMetrics are everything mq-server counts.
+//
+// network is the name given by State.NetworkOf to where a connection came from.
+// kind is murmur, murmur_udp, target or web. direction is upstream (from the
+// client) or downstream. target is murmur, murmur_udp, target or redir.
+// backend is the Name of a Murmur backend
+type serverMetrics struct {
+	connections       counterVec
+	dispatches        counterVec
+	handshakeFailures counterVec
+	activePipes       gaugeVec
+	pipeBytes         counterVec
+	dialDuration      histogramVec
+	dialErrors        counterVec
+	backendUp         gaugeVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		connections:       newCounterVec("mq_connections_accepted_total", "Connections accepted.", "network"),
+		dispatches:        newCounterVec("mq_dispatches_total", "Connections by what they turned out to be: masquerable, non_masquerable or malformed.", "network", "result"),
+		handshakeFailures: newCounterVec("mq_handshake_failures_total", "Connections dropped during the handshake, by the stage that failed.", "network", "stage"),
+		activePipes:       newGaugeVec("mq_active_pipes", "Pipes currently open.", "kind"),
+		pipeBytes:         newCounterVec("mq_pipe_bytes_total", "Bytes carried by pipes.", "kind", "direction"),
+		dialDuration:      newHistogramVec("mq_dial_duration_seconds", "Time taken to connect to Murmur, targets and the redirection server.", dialBuckets, "target"),
+		dialErrors:        newCounterVec("mq_dial_errors_total", "Failed connections to Murmur, targets and the redirection server.", "target"),
+		backendUp:         newGaugeVec("mq_backend_up", "Whether the last health check or connection to a Murmur backend succeeded.", "backend"),
+	}
+}
+
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	families := []*family{
+		m.connections.family,
+		m.dispatches.family,
+		m.handshakeFailures.family,
+		m.activePipes.family,
+		m.pipeBytes.family,
+		m.dialDuration.family,
+		m.dialErrors.family,
+		m.backendUp.family,
+	}
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+// countingWriter adds the bytes written through it to a counter
+type countingWriter struct {
+	io.Writer
+	counter *counter
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.Writer.Write(b)
+	cw.counter.add(uint64(n))
+	return n, err
+}
+
+// dial connects to addr, giving up after timeout, recording how long it took as target
+func dial(network, addr, target string, timeout time.Duration) (net.Conn, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		metrics.dialErrors.with(target).inc()
+		return nil, err
+	}
+	metrics.dialDuration.with(target).observe(time.Since(start).Seconds())
+	return conn, nil
+}
+
+// ServeMetrics serves /metrics on listener
+func ServeMetrics(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	return http.Serve(listener, mux)
+}
@@ -0,0 +1,452 @@
+// Package mqserver is what mq-server does with the connections it accepts:
+// passing them on to Murmur, the web server or a target, and counting them
+package mqserver
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/masquerable"
+	"github.com/cbeuw/masquerable/internal/drain"
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/server"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// Verbose enables Verbose logging
+var Verbose bool
+
+// Pipes tracks every connection so they can be drained on shutdown
+var Pipes = drain.NewTracker()
+
+var metrics = newServerMetrics()
+
+type msPair struct {
+	ms     net.Conn
+	remote net.Conn
+	user   *server.User
+	closed sync.Once
+}
+
+// udpPair carries Mumble voice datagrams between the tunnel and Murmur's UDP port
+type udpPair struct {
+	ms     net.Conn
+	remote net.Conn
+	user   *server.User
+	closed sync.Once
+}
+
+// targetPair carries a tunnel to a host:port the client asked for
+type targetPair struct {
+	target net.Conn
+	remote net.Conn
+	user   *server.User
+	addr   string
+	closed sync.Once
+}
+
+type webPair struct {
+	webServer net.Conn
+	remote    net.Conn
+	closed    sync.Once
+}
+
+func (pair *webPair) closePipe() {
+	pair.closed.Do(func() {
+		metrics.activePipes.with("web").dec()
+	})
+	go pair.webServer.Close()
+	go pair.remote.Close()
+}
+
+func (pair *msPair) closePipe() {
+	pair.closed.Do(func() {
+		metrics.activePipes.with("murmur").dec()
+		if Verbose {
+			log.Printf("Murmur pipe of %v closing\n", pair.user.Name)
+		}
+	})
+	go pair.ms.Close()
+	go pair.remote.Close()
+}
+
+func (pair *targetPair) closePipe() {
+	pair.closed.Do(func() {
+		metrics.activePipes.with("target").dec()
+		if Verbose {
+			log.Printf("Pipe of %v to %v closing\n", pair.user.Name, pair.addr)
+		}
+	})
+	go pair.target.Close()
+	go pair.remote.Close()
+}
+
+func (pair *udpPair) closePipe() {
+	pair.closed.Do(func() {
+		metrics.activePipes.with("murmur_udp").dec()
+		if Verbose {
+			log.Printf("Murmur UDP pipe of %v closing\n", pair.user.Name)
+		}
+	})
+	go pair.ms.Close()
+	go pair.remote.Close()
+}
+
+func (pair *webPair) serverToRemote() {
+	remote := countingWriter{pair.remote, metrics.pipeBytes.with("web", "downstream")}
+	for {
+		length, err := io.Copy(remote, pair.webServer)
+		if err != nil || length == 0 {
+			pair.closePipe()
+			return
+		}
+	}
+}
+
+func (pair *webPair) remoteToServer() {
+	webServer := countingWriter{pair.webServer, metrics.pipeBytes.with("web", "upstream")}
+	for {
+		length, err := io.Copy(webServer, pair.remote)
+		if err != nil || length == 0 {
+			pair.closePipe()
+			return
+		}
+	}
+}
+
+func (pair *msPair) remoteToServer() {
+	ms := countingWriter{pair.ms, metrics.pipeBytes.with("murmur", "upstream")}
+	buf := make([]byte, 16384)
+	for {
+		i, err := pair.remote.Read(buf)
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+		_, err = ms.Write(buf[:i])
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+	}
+}
+
+func (pair *msPair) serverToRemote() {
+	remote := countingWriter{pair.remote, metrics.pipeBytes.with("murmur", "downstream")}
+	buf := make([]byte, 16384)
+	for {
+		i, err := io.ReadAtLeast(pair.ms, buf, 1)
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+		_, err = remote.Write(buf[:i])
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+	}
+}
+
+func (pair *targetPair) remoteToTarget() {
+	target := countingWriter{pair.target, metrics.pipeBytes.with("target", "upstream")}
+	buf := make([]byte, 16384)
+	for {
+		i, err := pair.remote.Read(buf)
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+		_, err = target.Write(buf[:i])
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+	}
+}
+
+func (pair *targetPair) targetToRemote() {
+	remote := countingWriter{pair.remote, metrics.pipeBytes.with("target", "downstream")}
+	buf := make([]byte, 16384)
+	for {
+		i, err := io.ReadAtLeast(pair.target, buf, 1)
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+		_, err = remote.Write(buf[:i])
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+	}
+}
+
+func (pair *udpPair) remoteToServer() {
+	ms := countingWriter{pair.ms, metrics.pipeBytes.with("murmur_udp", "upstream")}
+	buf := make([]byte, 65536)
+	for {
+		i, err := tunnel.ReadDatagram(pair.remote, buf)
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+		_, err = ms.Write(buf[:i])
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+	}
+}
+
+func (pair *udpPair) serverToRemote() {
+	downstream := metrics.pipeBytes.with("murmur_udp", "downstream")
+	buf := make([]byte, 65536)
+	for {
+		i, err := pair.ms.Read(buf)
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+		err = tunnel.WriteDatagram(pair.remote, buf[:i])
+		if err != nil {
+			pair.closePipe()
+			return
+		}
+		downstream.add(uint64(i))
+	}
+}
+
+// goWeb passes conn, which isn't masquerable, on to the web server along
+// with data, what has been read from it already
+func goWeb(conn net.Conn, data []byte, sta *server.State) {
+	pair, err := makeWebPipe(conn, sta)
+	if err != nil {
+		log.Printf("Making connection to redirection server: %v\n", err)
+		go conn.Close()
+		return
+	}
+	n, _ := pair.webServer.Write(data)
+	metrics.pipeBytes.with("web", "upstream").add(uint64(n))
+	Pipes.Spawn(pair.remoteToServer)
+	Pipes.Spawn(pair.serverToRemote)
+}
+
+// goMs connects remote, either a tunnel or a stream on one, to a Murmur
+// backend. serverName is what remote's ClientHello asked for
+func goMs(remote net.Conn, user *server.User, serverName string, sta *server.State) {
+	pair, err := makeMsPipe(remote, user, serverName, sta)
+	if err != nil {
+		log.Printf("Making connection to Murmur for %v: %v\n", user.Name, err)
+		go remote.Close()
+		return
+	}
+	if Verbose {
+		log.Printf("New Murmur pipe for %v from %v\n", user.Name, remote.RemoteAddr())
+	}
+	Pipes.Spawn(pair.remoteToServer)
+	Pipes.Spawn(pair.serverToRemote)
+}
+
+func goUDP(remote net.Conn, user *server.User, serverName string, sta *server.State) {
+	pair, err := makeUDPPipe(remote, user, serverName, sta)
+	if err != nil {
+		log.Printf("Making UDP connection to Murmur for %v: %v\n", user.Name, err)
+		go remote.Close()
+		return
+	}
+	if Verbose {
+		log.Printf("New Murmur UDP pipe for %v from %v\n", user.Name, remote.RemoteAddr())
+	}
+	Pipes.Spawn(pair.remoteToServer)
+	Pipes.Spawn(pair.serverToRemote)
+}
+
+// goTarget connects remote to the target it asked for, if its user may reach it
+func goTarget(remote net.Conn, user *server.User, addr string, sta *server.State) {
+	if !sta.TargetAllowed(user, addr) {
+		log.Printf("%v asked for %v, which isn't among their targets\n", user.Name, addr)
+		go remote.Close()
+		return
+	}
+	pair, err := makeTargetPipe(remote, user, addr, sta)
+	if err != nil {
+		log.Printf("Making connection to %v for %v: %v\n", addr, user.Name, err)
+		go remote.Close()
+		return
+	}
+	if Verbose {
+		log.Printf("New pipe to %v for %v from %v\n", addr, user.Name, remote.RemoteAddr())
+	}
+	Pipes.Spawn(pair.remoteToTarget)
+	Pipes.Spawn(pair.targetToRemote)
+}
+
+// CloneLoop clones the handshake of the web server every CloneInterval of
+// the current State. It never returns
+func CloneLoop(state func() *server.State) {
+	for {
+		sta := state()
+		if sta.CloneInterval == 0 {
+			sta.Shapes.Clear()
+			time.Sleep(time.Minute)
+			continue
+		}
+		err := server.CloneShapes(sta, sta.Shapes)
+		if err != nil {
+			log.Printf("Cloning the handshake of %v: %v\n", sta.RedirAddr, err)
+		} else if Verbose {
+			log.Printf("Cloned the handshake of %v\n", sta.RedirAddr)
+		}
+		time.Sleep(sta.CloneInterval)
+	}
+}
+
+// Serve passes every stream listener accepts on to where it goes, until
+// listener is closed
+func Serve(listener *masquerable.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		mqConn := conn.(*masquerable.Conn)
+		if Verbose && mqConn.KDF == kdf.Legacy {
+			log.Printf("%v is still on the legacy KDF\n", mqConn.User.Name)
+		}
+		sta := listener.State()
+		// Dialing may take up to DialTimeout, which mustn't hold up the others
+		switch mqConn.Kind {
+		case tunnel.KindTCP:
+			Pipes.Spawn(func() { goMs(mqConn, mqConn.User, mqConn.ServerName, sta) })
+		case tunnel.KindUDP:
+			Pipes.Spawn(func() { goUDP(mqConn, mqConn.User, mqConn.ServerName, sta) })
+		case tunnel.KindTarget:
+			Pipes.Spawn(func() { goTarget(mqConn, mqConn.User, mqConn.Target, sta) })
+		}
+	}
+}
+
+// Listen is masquerable.Listen, with every connection put in Pipes and
+// the ones that don't make it to Accept logged, counted and passed on to
+// the web server
+func Listen(inner net.Listener, sta *server.State) *masquerable.Listener {
+	listener := masquerable.Listen(trackedListener{inner}, sta)
+	setHooks(listener)
+	return listener
+}
+
+// trackedListener puts every connection it accepts in Pipes
+type trackedListener struct {
+	net.Listener
+}
+
+func (l trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Pipes.Track(conn), nil
+}
+
+// setHooks makes listener log, count and pass on to the web server the
+// connections that don't make it to Accept
+func setHooks(listener *masquerable.Listener) {
+	listener.Fallback = func(conn net.Conn, data []byte, err error) {
+		sta := listener.State()
+		network := sta.NetworkOf(conn.RemoteAddr())
+		metrics.connections.with(network).inc()
+		if errors.Is(err, masquerable.ErrMalformed) {
+			metrics.dispatches.with(network, "malformed").inc()
+			if Verbose {
+				log.Printf("+1 non masquerable non (or malformed) TLS traffic from %v: %v\n", conn.RemoteAddr(), err)
+			}
+		} else {
+			metrics.dispatches.with(network, "non_masquerable").inc()
+			if Verbose {
+				log.Printf("+1 non masquerable TLS traffic from %v: %v\n", conn.RemoteAddr(), err)
+			}
+		}
+		goWeb(conn, data, sta)
+	}
+	listener.Authenticated = func(conn net.Conn, user *server.User) {
+		network := listener.State().NetworkOf(conn.RemoteAddr())
+		metrics.connections.with(network).inc()
+		metrics.dispatches.with(network, "masquerable").inc()
+	}
+	listener.HandshakeFailed = func(conn net.Conn, stage string, err error) {
+		network := listener.State().NetworkOf(conn.RemoteAddr())
+		// Connections that send nothing never got as far as the other hooks
+		if stage == masquerable.StageClientHello {
+			metrics.connections.with(network).inc()
+			log.Println(err)
+		} else if Verbose {
+			log.Printf("Handshake with %v failed at %v: %v\n", conn.RemoteAddr(), stage, err)
+		}
+		metrics.handshakeFailures.with(network, stage).inc()
+	}
+}
+
+func makeWebPipe(remote net.Conn, sta *server.State) (*webPair, error) {
+	conn, err := dial("tcp", sta.RedirAddr, "redir", sta.DialTimeout)
+	if err != nil {
+		return &webPair{}, err
+	}
+	pair := &webPair{
+		webServer: Pipes.Track(conn),
+		remote:    remote,
+	}
+	metrics.activePipes.with("web").inc()
+	return pair, nil
+}
+
+func makeMsPipe(remote net.Conn, user *server.User, serverName string, sta *server.State) (*msPair, error) {
+	conn, err := backends.dialMurmur(sta, user, serverName)
+	if err != nil {
+		return &msPair{}, err
+	}
+	pair := &msPair{
+		ms:     Pipes.Track(conn),
+		remote: remote,
+		user:   user,
+	}
+	metrics.activePipes.with("murmur").inc()
+	return pair, nil
+}
+
+func makeTargetPipe(remote net.Conn, user *server.User, addr string, sta *server.State) (*targetPair, error) {
+	conn, err := dial("tcp", addr, "target", sta.DialTimeout)
+	if err != nil {
+		return &targetPair{}, err
+	}
+	pair := &targetPair{
+		target: Pipes.Track(conn),
+		remote: remote,
+		user:   user,
+		addr:   addr,
+	}
+	metrics.activePipes.with("target").inc()
+	return pair, nil
+}
+
+func makeUDPPipe(remote net.Conn, user *server.User, serverName string, sta *server.State) (*udpPair, error) {
+	addr, err := backends.voiceAddr(sta, user, serverName)
+	if err != nil {
+		return &udpPair{}, err
+	}
+	conn, err := dial("udp", addr, "murmur_udp", sta.DialTimeout)
+	if err != nil {
+		return &udpPair{}, err
+	}
+	pair := &udpPair{
+		ms:     Pipes.Track(conn),
+		remote: remote,
+		user:   user,
+	}
+	metrics.activePipes.with("murmur_udp").inc()
+	return pair, nil
+}
@@ -0,0 +1,387 @@
+package mqserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/masquerable"
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/server"
+)
+
+// fakeServer stands in for Murmur or the web server. It sends banner to
+// every connection it accepts and then echoes back whatever it reads.
+// Accepted connections and the first thing read from each are passed on
+type fakeServer struct {
+	net.Listener
+	banner    []byte
+	conns     chan net.Conn
+	firstRead chan []byte
+}
+
+func newFakeServer(t *testing.T, banner string) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeServer{
+		Listener:  listener,
+		banner:    []byte(banner),
+		conns:     make(chan net.Conn, 16),
+		firstRead: make(chan []byte, 16),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fake.conns <- conn
+			go fake.handle(conn)
+		}
+	}()
+	return fake
+}
+
+func (fake *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.Write(fake.banner)
+	buf := make([]byte, 65536)
+	first := true
+	for {
+		i, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if first {
+			fake.firstRead <- append([]byte{}, buf[:i]...)
+			first = false
+		}
+		_, err = conn.Write(buf[:i])
+		if err != nil {
+			return
+		}
+	}
+}
+
+const webBanner = "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n"
+
+// harness is mq-server running in-process on loopback, with fake Murmur
+// and web servers behind it
+type harness struct {
+	addr     string
+	murmur   *fakeServer
+	web      *fakeServer
+	listener *masquerable.Listener
+}
+
+func newHarness(t *testing.T) *harness {
+	return newHarnessWith(t, nil)
+}
+
+// newHarnessWith is newHarness with tweak applied to the State before it
+// is validated
+func newHarnessWith(t *testing.T, tweak func(sta *server.State)) *harness {
+	murmur := newFakeServer(t, "")
+	web := newFakeServer(t, webBanner)
+	sta := &server.State{
+		RedirAddr:           web.Addr().String(),
+		MurmurAddr:          murmur.Addr().String(),
+		BindAddr:            "127.0.0.1:0",
+		Now:                 time.Now,
+		Users:               []*server.User{server.NewUser("alice", "correct horse")},
+		KDFs:                []string{kdf.HKDF, kdf.Legacy},
+		MaxSkew:             time.Minute,
+		HandshakeTimeout:    3 * time.Second,
+		DialTimeout:         time.Second,
+		HealthCheckInterval: time.Minute,
+		// Each end pads differently, and strips whatever the other does
+		Padding:         "https",
+		Shaping:         "browsing",
+		ShapingLatency:  5 * time.Millisecond,
+		ShapingOverhead: 32768,
+	}
+	sta.Replay = server.NewReplayCache(1024, 2*sta.MaxSkew)
+	if tweak != nil {
+		tweak(sta)
+	}
+	err := sta.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", sta.BindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := Listen(inner, sta)
+	go Serve(listener)
+	t.Cleanup(func() { listener.Close() })
+	return &harness{inner.Addr().String(), murmur, web, listener}
+}
+
+// dial connects to the harness the way mq-client does
+func (h *harness) dial(t *testing.T, key string, browser string, tls13 bool) (net.Conn, error) {
+	return h.dialWith(t, &client.State{
+		Key:        key,
+		ServerName: "www.example.com",
+		Browser:    browser,
+		TLS13:      tls13,
+		Padding:    "fixed",
+	})
+}
+
+func (h *harness) dialWith(t *testing.T, sta *client.State) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return masquerable.Dial(ctx, h.addr, sta)
+}
+
+// accepted waits for the next connection to fake
+func accepted(t *testing.T, fake *fakeServer) net.Conn {
+	select {
+	case conn := <-fake.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing connected")
+		return nil
+	}
+}
+
+// readClosed waits for conn to be closed from the other end
+func readClosed(t *testing.T, conn net.Conn, what string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("%v wasn't closed", what)
+	}
+}
+
+func TestMurmurGetsTrafficIntact(t *testing.T) {
+	h := newHarness(t)
+	browsers := []struct {
+		name    string
+		browser string
+		tls13   bool
+	}{
+		{"chrome", "chrome", false},
+		{"chrome tls13", "chrome", true},
+		{"firefox", "firefox", false},
+	}
+	for _, b := range browsers {
+		t.Run(b.name, func(t *testing.T) {
+			conn, err := h.dial(t, "correct horse", b.browser, b.tls13)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// Large enough to span many records
+			sent := make([]byte, 1<<20)
+			rand.Read(sent)
+			go conn.Write(sent)
+			got := make([]byte, len(sent))
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			_, err = io.ReadFull(conn, got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, sent) {
+				t.Fatal("Echo from Murmur differs from what was sent")
+			}
+			if first := <-h.murmur.firstRead; !bytes.Equal(first, sent[:len(first)]) {
+				t.Fatal("Murmur got something other than what was sent")
+			}
+		})
+	}
+}
+
+func TestWrongKeyGoesToWeb(t *testing.T) {
+	h := newHarness(t)
+	_, err := h.dial(t, "wrong", "chrome", false)
+	if err == nil {
+		t.Fatal("Handshake with the wrong key succeeded")
+	}
+	accepted(t, h.web)
+	first := <-h.web.firstRead
+	// The ClientHello is passed on as it is
+	if len(first) < 6 || first[0] != 0x16 || first[5] != 0x01 {
+		t.Fatalf("Web server got %x, not a ClientHello", first)
+	}
+	select {
+	case <-h.murmur.conns:
+		t.Fatal("Murmur was connected to")
+	default:
+	}
+}
+
+func TestKDFNegotiation(t *testing.T) {
+	h := newHarness(t)
+	cases := []struct {
+		name    string
+		kdf     string
+		salt    string
+		allowed bool
+	}{
+		{"hkdf", kdf.HKDF, "", true},
+		{"legacy", kdf.Legacy, "", true},
+		// The server has no salt
+		{"hkdf with salt", kdf.HKDF, "mq.example.com", false},
+	}
+	for _, c := range cases {
+		conn, err := h.dialWith(t, &client.State{
+			Key:        "correct horse",
+			ServerName: "www.example.com",
+			KDF:        c.kdf,
+			KeySalt:    c.salt,
+		})
+		if c.allowed != (err == nil) {
+			t.Fatalf("%v: got %v", c.name, err)
+		}
+		if err != nil {
+			continue
+		}
+		conn.Write([]byte("hello"))
+		accepted(t, h.murmur)
+		<-h.murmur.firstRead
+		conn.Close()
+	}
+}
+
+func TestGarbageGoesToWeb(t *testing.T) {
+	h := newHarness(t)
+	for _, garbage := range []string{
+		"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+		"\x16\x03\x01\x00\x05hello",
+	} {
+		conn, err := net.Dial("tcp", h.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(garbage))
+		want := webBanner + garbage
+		got := make([]byte, len(want))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(conn, got)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", garbage, err)
+		}
+		if string(got) != want {
+			t.Fatalf("%q: got %q back from the web server", garbage, got)
+		}
+	}
+}
+
+func TestClientCloseTearsDownPipe(t *testing.T) {
+	h := newHarness(t)
+	conn, err := h.dial(t, "correct horse", "chrome", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	ms := accepted(t, h.murmur)
+	<-h.murmur.firstRead
+	conn.Close()
+	readClosed(t, ms, "Murmur's side")
+}
+
+func TestMurmurCloseTearsDownPipe(t *testing.T) {
+	h := newHarness(t)
+	conn, err := h.dial(t, "correct horse", "chrome", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	ms := accepted(t, h.murmur)
+	<-h.murmur.firstRead
+	ms.Close()
+	readClosed(t, conn, "The client's side")
+}
+
+func TestWebCloseTearsDownPipe(t *testing.T) {
+	h := newHarness(t)
+	conn, err := net.Dial("tcp", h.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	web := accepted(t, h.web)
+	<-h.web.firstRead
+	web.Close()
+	readClosed(t, conn, "The prober's side")
+}
+
+func TestHangingTargetDoesntHoldUpOthers(t *testing.T) {
+	hanging := hangingAddr(t)
+	h := newHarnessWith(t, func(sta *server.State) {
+		sta.Targets = map[string][]string{server.AllUsers: {hanging}}
+		sta.DialTimeout = 5 * time.Second
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	target, err := masquerable.DialTarget(ctx, h.addr, &client.State{
+		Key:        "correct horse",
+		ServerName: "www.example.com",
+	}, hanging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	// Give Serve time to get stuck on it, if it does
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	conn, err := h.dial(t, "correct horse", "chrome", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	select {
+	case <-h.murmur.firstRead:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Murmur pipe waited on the hanging target")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Murmur pipe took %v", elapsed)
+	}
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	h := newHarnessWith(t, func(sta *server.State) {
+		sta.KDFs = []string{kdf.Argon2id}
+		sta.KeySalt = "mq.example.com"
+	})
+	sta := &client.State{
+		Key:        "correct horse",
+		ServerName: "www.example.com",
+		KDF:        kdf.Argon2id,
+		KeySalt:    "mq.example.com",
+	}
+	conn, err := h.dialWith(t, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	accepted(t, h.murmur)
+	if first := <-h.murmur.firstRead; string(first) != "hello" {
+		t.Fatalf("Murmur got %q", first)
+	}
+
+	// Either end with another salt derives other keys
+	sta.KeySalt = "other.example.com"
+	_, err = h.dialWith(t, sta)
+	if err == nil {
+		t.Fatal("Handshake with keys of another salt succeeded")
+	}
+}
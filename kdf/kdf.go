@@ -0,0 +1,114 @@
+// Package kdf derives the keys mq-client and mq-server share from a user's key
+package kdf
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The ways of deriving keys
+const (
+	// Legacy uses sha256(Key) for everything, as before there was a choice.
+	// It's only there for clients that haven't been updated yet
+	Legacy = "legacy"
+	// HKDF derives a key for each purpose with HKDF-SHA256
+	HKDF = "hkdf"
+	// Argon2id runs Key through Argon2id, salted with the server's KeySalt,
+	// before HKDF, so that weak keys are much slower to guess
+	Argon2id = "argon2id"
+)
+
+// The Argon2id cost, RFC 9106's second recommended option
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// Keys are derived from a user's key, one for each purpose
+type Keys struct {
+	// KDF is how they were derived
+	KDF string
+	// Auth hides the timestamp in the ClientHello random and the flight
+	// lengths in the server random
+	Auth []byte
+	// Ticket seeds the session ticket
+	Ticket []byte
+	// Payload is what the session keys of the tunnel are derived from
+	Payload []byte
+
+	// proof is what authenticates a timestamp
+	proof func(timestamp []byte) []byte
+}
+
+// Check returns an error if kdf isn't known, or needs a salt and there's none
+func Check(kdf string, salt string) error {
+	switch kdf {
+	case Legacy, HKDF:
+		return nil
+	case Argon2id:
+		if salt == "" {
+			return errors.New("KeySalt must be set for argon2id")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown KDF %v", kdf)
+}
+
+// Derive derives Keys from key with kdf. salt is the server's KeySalt, the
+// same for every user. Argon2id takes a good fraction of a second
+func Derive(key string, kdf string, salt string) (*Keys, error) {
+	err := Check(kdf, salt)
+	if err != nil {
+		return nil, err
+	}
+	if kdf == Legacy {
+		h := sha256.Sum256([]byte(key))
+		return &Keys{
+			KDF:     Legacy,
+			Auth:    h[:],
+			Ticket:  h[:],
+			Payload: h[:],
+			proof: func(timestamp []byte) []byte {
+				h := sha256.New()
+				h.Write(timestamp)
+				h.Write([]byte(key))
+				return h.Sum(nil)[:12]
+			},
+		}, nil
+	}
+
+	secret := []byte(key)
+	if kdf == Argon2id {
+		argonSalt := sha256.Sum256([]byte("masquerable argon2id salt " + salt))
+		secret = argon2.IDKey(secret, argonSalt[:], argon2Time, argon2Memory, argon2Threads, 32)
+	}
+	expand := func(label string) []byte {
+		ret, _ := hkdf.Key(sha256.New, secret, []byte(salt), "masquerable "+kdf+" "+label, 32)
+		return ret
+	}
+	keys := &Keys{
+		KDF:     kdf,
+		Auth:    expand("auth"),
+		Ticket:  expand("ticket"),
+		Payload: expand("payload"),
+	}
+	proofKey := expand("proof")
+	keys.proof = func(timestamp []byte) []byte {
+		mac := hmac.New(sha256.New, proofKey)
+		mac.Write(timestamp)
+		return mac.Sum(nil)[:12]
+	}
+	return keys, nil
+}
+
+// Proof is the 12 bytes that go with timestamp in the ClientHello random
+// to show the client has the key
+func (keys *Keys) Proof(timestamp []byte) []byte {
+	return keys.proof(timestamp)
+}
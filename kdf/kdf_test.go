@@ -0,0 +1,63 @@
+package kdf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDeriveLegacy(t *testing.T) {
+	keys, err := Derive("test", Legacy, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte("test"))
+	if !bytes.Equal(keys.Auth, h[:]) || !bytes.Equal(keys.Ticket, h[:]) || !bytes.Equal(keys.Payload, h[:]) {
+		t.Error("Legacy keys aren't sha256(Key)")
+	}
+}
+
+func TestDeriveSeparatesKeys(t *testing.T) {
+	keys, err := Derive("test", HKDF, "mq.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(keys.Auth, keys.Ticket) || bytes.Equal(keys.Auth, keys.Payload) || bytes.Equal(keys.Ticket, keys.Payload) {
+		t.Error("Keys for different purposes are the same")
+	}
+	other, _ := Derive("test", HKDF, "other.example.com")
+	if bytes.Equal(keys.Auth, other.Auth) {
+		t.Error("Salt makes no difference")
+	}
+	if _, err := Derive("test", Argon2id, ""); err == nil {
+		t.Error("Argon2id without a salt was accepted")
+	}
+}
+
+func TestDeriveArgon2id(t *testing.T) {
+	keys, err := Derive("correct horse", Argon2id, "mq.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Worked out with RFC 9106's Argon2id and RFC 5869's HKDF-SHA256 apart
+	// from this package
+	want := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"Auth", keys.Auth, "1d417381df463e8394df8e8f8408a1b20300a7368f72d2fa7f9eec36f8ed7c3b"},
+		{"Ticket", keys.Ticket, "d97f4da84c69244d812fd6efce78f327b44598a433f0596b82021d24b363b76d"},
+		{"Payload", keys.Payload, "5c55fb6bf7fc16793f495fb5e63b71b17c1ba86faf5ad0e17c2292eea681bd5f"},
+	}
+	for _, w := range want {
+		if hex.EncodeToString(w.got) != w.want {
+			t.Errorf("%v = %x, want %v", w.name, w.got, w.want)
+		}
+	}
+	hkdf, _ := Derive("correct horse", HKDF, "mq.example.com")
+	if bytes.Equal(keys.Auth, hkdf.Auth) {
+		t.Error("Argon2id keys are the same as HKDF ones")
+	}
+}
@@ -0,0 +1,331 @@
+package masquerable
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/masquerable/mux"
+	"github.com/cbeuw/masquerable/server"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// ErrMalformed is wrapped by the error given to Fallback when a connection
+// didn't start with a well formed ClientHello. If the ClientHello was read
+// but couldn't be parsed, the error also wraps a *server.HelloError
+var ErrMalformed = errors.New("Malformed ClientHello")
+
+// ErrNotMasquerable is wrapped by the error given to Fallback when a
+// ClientHello didn't authenticate as any user
+var ErrNotMasquerable = errors.New("Not a masquerable ClientHello")
+
+// The stages of the handshake given to HandshakeFailed
+const (
+	StageClientHello = "client_hello"
+	StageServerHello = "server_hello"
+	StageFinished    = "finished"
+	StageHeader      = "header"
+)
+
+// Conn is an authenticated stream from mq-client
+type Conn struct {
+	net.Conn
+	// User is who the stream authenticated as
+	User *server.User
+	// Kind is what the stream carries, tunnel.KindTCP, tunnel.KindUDP or
+	// tunnel.KindTarget
+	Kind byte
+	// Target is the host:port a KindTarget stream asked to be forwarded to.
+	// It is up to whoever accepts the stream to check it's allowed
+	Target string
+	// ServerName is what the ClientHello asked for in its server name
+	// indication
+	ServerName string
+	// KDF is how the keys the stream authenticated with were derived, see
+	// server.State.KDFs
+	KDF string
+}
+
+// Listener accepts connections from mq-client on an inner net.Listener.
+// Connections that aren't masquerable are given to Fallback, so that they can
+// be passed on to a real web server. Multiplexed tunnels are taken apart
+// and each of their streams is accepted on its own.
+//
+// The hooks must be set before the first call to Accept and must not block
+type Listener struct {
+	// Fallback is given each connection that isn't masquerable, with what
+	// has been read from it. err wraps ErrMalformed or ErrNotMasquerable.
+	// If Fallback is nil such connections are closed
+	Fallback func(conn net.Conn, data []byte, err error)
+	// Authenticated, if not nil, is told about every tunnel that passes
+	// authentication, before its handshake is finished
+	Authenticated func(conn net.Conn, user *server.User)
+	// HandshakeFailed, if not nil, is told about every connection that is
+	// closed during the handshake. stage is one of the Stage constants
+	HandshakeFailed func(conn net.Conn, stage string, err error)
+
+	inner net.Listener
+	state atomic.Value
+
+	conns   chan *Conn
+	closing chan struct{}
+	closed  chan struct{}
+	start   sync.Once
+	once    sync.Once
+
+	// handshakes are the connections still in the handshake
+	mutex      sync.Mutex
+	handshakes map[net.Conn]struct{}
+	wg         sync.WaitGroup
+}
+
+// Listen makes a Listener that accepts connections on inner, authenticating
+// them against sta. The keys of sta's users are derived first, unless
+// sta.DerivedKeys has them already. Nothing is accepted from inner until
+// Accept is first called
+func Listen(inner net.Listener, sta *server.State) *Listener {
+	// Users of KDFs that sta.Validate rejects just can't authenticate
+	sta.DeriveKeys()
+	l := &Listener{
+		inner:      inner,
+		conns:      make(chan *Conn),
+		closing:    make(chan struct{}),
+		closed:     make(chan struct{}),
+		handshakes: make(map[net.Conn]struct{}),
+	}
+	l.state.Store(sta)
+	return l
+}
+
+// State returns the State new connections are authenticated against
+func (l *Listener) State() *server.State {
+	return l.state.Load().(*server.State)
+}
+
+// SetState changes the State new connections are authenticated against,
+// deriving keys like Listen. Established connections aren't affected
+func (l *Listener) SetState(sta *server.State) {
+	sta.DeriveKeys()
+	l.state.Store(sta)
+}
+
+// Accept waits for the next authenticated stream
+func (l *Listener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		go l.acceptLoop()
+	})
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr is the address of the inner listener
+func (l *Listener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+// Close stops accepting, closes the inner listener and cuts the handshakes
+// in progress. It returns once none of the hooks will be called again.
+// Established connections carry on
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closing)
+		err = l.inner.Close()
+		l.mutex.Lock()
+		for conn := range l.handshakes {
+			conn.Close()
+		}
+		l.mutex.Unlock()
+		l.wg.Wait()
+		close(l.closed)
+	})
+	return err
+}
+
+func (l *Listener) isClosing() bool {
+	select {
+	case <-l.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || l.isClosing() {
+				return
+			}
+			// Temporary errors such as running out of file descriptors
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		l.mutex.Lock()
+		if l.isClosing() {
+			l.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		l.handshakes[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mutex.Unlock()
+		go func() {
+			defer l.wg.Done()
+			l.handshake(conn, l.State())
+			l.handedOver(conn)
+		}()
+	}
+}
+
+// handedOver stops conn from being cut by Close, now that the handshake is
+// over one way or another
+func (l *Listener) handedOver(conn net.Conn) {
+	l.mutex.Lock()
+	delete(l.handshakes, conn)
+	l.mutex.Unlock()
+}
+
+func (l *Listener) fallback(conn net.Conn, data []byte, err error) {
+	l.handedOver(conn)
+	if l.Fallback == nil || l.isClosing() {
+		conn.Close()
+		return
+	}
+	l.Fallback(conn, data, err)
+}
+
+func (l *Listener) fail(conn net.Conn, stage string, err error) {
+	if l.HandshakeFailed != nil && !l.isClosing() {
+		l.HandshakeFailed(conn, stage, err)
+	}
+	conn.Close()
+}
+
+// deliver hands conn to Accept
+func (l *Listener) deliver(conn *Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closing:
+		conn.Close()
+	}
+}
+
+func (l *Listener) handshake(conn net.Conn, sta *server.State) {
+	conn.SetReadDeadline(time.Now().Add(sta.HandshakeTimeout))
+	data, hello, err := server.ReadClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	if len(data) == 0 {
+		l.fail(conn, StageClientHello, err)
+		return
+	}
+	if err != nil {
+		l.fallback(conn, data, fmt.Errorf("%w: %v", ErrMalformed, err))
+		return
+	}
+	ch, err := server.ParseClientHello(hello)
+	if err != nil {
+		l.fallback(conn, data, fmt.Errorf("%w: %w", ErrMalformed, err))
+		return
+	}
+
+	user, keys, err := server.IsMq(ch, sta)
+	if user == nil {
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrNotMasquerable, err)
+		} else {
+			err = ErrNotMasquerable
+		}
+		l.fallback(conn, data, err)
+		return
+	}
+	if l.Authenticated != nil && !l.isClosing() {
+		l.Authenticated(conn, user)
+	}
+
+	flights := server.ComposeReply(ch, keys.Auth, sta.Shapes)
+	_, err = conn.Write(flights[0])
+	if err != nil {
+		l.fail(conn, StageServerHello, err)
+		return
+	}
+
+	// The client's discarded messages, ending with ChangeCipherSpec and Finished
+	err = server.ReadClientReply(conn)
+	if err != nil {
+		l.fail(conn, StageFinished, fmt.Errorf("Reading discarded messages: %v", err))
+		return
+	}
+	// The rest of a full TLS 1.2 handshake, or the tickets a TLS 1.3 server
+	// sends once the client has finished
+	if len(flights) > 1 {
+		_, err = conn.Write(flights[1])
+		if err != nil {
+			l.fail(conn, StageFinished, err)
+			return
+		}
+	}
+
+	remote := tunnel.Server(conn, keys.Payload, ch.Random())
+	// Padding or shaping Validate wouldn't pass is left out
+	padding, _ := tunnel.ParsePadding(sta.Padding)
+	remote.SetPadding(padding)
+	remote.SetShaping(sta.TunnelShaping())
+	conn.SetReadDeadline(time.Now().Add(sta.HandshakeTimeout))
+	kind, err := tunnel.ReadHeader(remote)
+	var target string
+	if err == nil && kind == tunnel.KindTarget {
+		target, err = tunnel.ReadTarget(remote)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		l.fail(conn, StageHeader, err)
+		return
+	}
+
+	l.handedOver(conn)
+	if kind != tunnel.KindMux {
+		l.deliver(&Conn{remote, user, kind, target, ch.ServerName(), keys.KDF})
+		return
+	}
+	serverName := ch.ServerName()
+	session := mux.Server(remote, sta.KeepAlive)
+	// The session outlives the handshake, so it isn't waited for by Close
+	go func() {
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			switch stream.Kind {
+			case tunnel.KindTCP, tunnel.KindUDP:
+				l.deliver(&Conn{stream, user, stream.Kind, "", serverName, keys.KDF})
+			case tunnel.KindTarget:
+				go l.deliverTarget(stream, user, serverName, keys.KDF, sta.HandshakeTimeout)
+			default:
+				stream.Close()
+			}
+		}
+	}()
+}
+
+// deliverTarget reads where a KindTarget stream on a multiplexed tunnel
+// wants to go before handing it to Accept
+func (l *Listener) deliverTarget(stream *mux.Stream, user *server.User, serverName string, kdfName string, timeout time.Duration) {
+	stream.SetReadDeadline(time.Now().Add(timeout))
+	target, err := tunnel.ReadTarget(stream)
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		stream.Close()
+		return
+	}
+	l.deliver(&Conn{stream, user, tunnel.KindTarget, target, serverName, kdfName})
+}
@@ -0,0 +1,337 @@
+// Package mux carries many streams over a single tunnel, so that mq-client
+// doesn't have to make a new disguised connection for every Mumble session.
+//
+// Everything is sent in frames of
+//
+//	type (1 byte) | stream ID (4 bytes) | payload length (2 bytes) | payload
+//
+// Only the client opens streams. Each direction of a stream has a window of
+// how many bytes may be sent before the receiver has read them, so one slow
+// stream can't hold up the others
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// frameOpen opens a stream. The payload is the kind of stream
+	frameOpen byte = 0x00
+	frameData byte = 0x01
+	// frameClose closes both directions of a stream
+	frameClose byte = 0x02
+	// frameWindow lets the sender send 4 byte big endian payload more bytes
+	frameWindow byte = 0x03
+	framePing   byte = 0x04
+	framePong   byte = 0x05
+)
+
+const frameHeaderLen = 7
+
+// A data frame, header included, fits in a single tunnel record
+const maxFramePayload = 16384 - frameHeaderLen
+
+// initialWindow is how much may be sent on a new stream before hearing back
+const initialWindow = 256 * 1024
+
+// How many opened streams may wait for Accept before more are refused
+const acceptBacklog = 256
+
+// How many control frames may wait to be sent before the session is given
+// up on, as the other end can't be reading
+const controlBacklog = 1024
+
+// ErrSessionClosed is returned by a Session, and by the streams waiting on
+// it, once it has been closed with Close
+var ErrSessionClosed = errors.New("Mux: session closed")
+var errStreamClosed = errors.New("Mux: stream closed")
+var errBadFrame = errors.New("Mux: unknown frame type")
+var errWindowExceeded = errors.New("Mux: peer sent more than the window allows")
+var errNotServer = errors.New("Mux: only the server accepts streams")
+var errNotClient = errors.New("Mux: only the client opens streams")
+var errTimeout = errors.New("Mux: no frames within the keepalive timeout")
+var errControlBacklog = errors.New("Mux: too many control frames waiting to be sent")
+
+// Session is one tunnel carrying many streams
+type Session struct {
+	conn     net.Conn
+	isClient bool
+
+	writeMutex sync.Mutex
+	// control holds the frames sendControl sends, in order
+	control chan controlFrame
+
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	accept chan *Stream
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeErr  error
+
+	keepAlive time.Duration
+	// lastRead is the UnixNano of when the last frame arrived
+	lastRead int64
+}
+
+func newSession(conn net.Conn, isClient bool, keepAlive time.Duration) *Session {
+	s := &Session{
+		conn:      conn,
+		isClient:  isClient,
+		streams:   make(map[uint32]*Stream),
+		nextID:    1,
+		accept:    make(chan *Stream, acceptBacklog),
+		control:   make(chan controlFrame, controlBacklog),
+		closed:    make(chan struct{}),
+		keepAlive: keepAlive,
+		lastRead:  time.Now().UnixNano(),
+	}
+	go s.recvLoop()
+	go s.controlLoop()
+	if keepAlive > 0 {
+		go s.keepAliveLoop()
+	}
+	return s
+}
+
+// Client makes the session on the mq-client side of conn. A ping is sent
+// every keepAlive and the session is closed if nothing has been heard for
+// three times that. A keepAlive of 0 disables both
+func Client(conn net.Conn, keepAlive time.Duration) *Session {
+	return newSession(conn, true, keepAlive)
+}
+
+// Server makes the session on the mq-server side of conn. keepAlive is the
+// same as for Client
+func Server(conn net.Conn, keepAlive time.Duration) *Session {
+	return newSession(conn, false, keepAlive)
+}
+
+// Open opens a new stream. kind is passed to the other end in Stream.Kind
+func (s *Session) Open(kind byte) (*Stream, error) {
+	if !s.isClient {
+		return nil, errNotClient
+	}
+	s.mutex.Lock()
+	if s.IsClosed() {
+		s.mutex.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	s.nextID++
+	stream := newStream(s, id, kind)
+	s.streams[id] = stream
+	s.mutex.Unlock()
+
+	err := s.writeFrame(frameOpen, id, []byte{kind})
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the client to open a stream
+func (s *Session) Accept() (*Stream, error) {
+	if s.isClient {
+		return nil, errNotServer
+	}
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.closeErr
+	}
+}
+
+// Close closes the session, its tunnel and every stream on it
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.closeErr = err
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+// IsClosed tells if the session can no longer carry streams
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// NumStreams is how many streams are open on the session
+func (s *Session) NumStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *Session) removeStream(id uint32) {
+	s.mutex.Lock()
+	delete(s.streams, id)
+	s.mutex.Unlock()
+}
+
+func (s *Session) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderLen+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint16(frame[5:7], uint16(len(payload)))
+	copy(frame[frameHeaderLen:], payload)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	_, err := s.conn.Write(frame)
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+type controlFrame struct {
+	frameType byte
+	id        uint32
+	payload   []byte
+}
+
+// sendControl queues a frame that isn't data for controlLoop. It doesn't
+// wait, so that recvLoop never blocks on writing. If too many are queued
+// already the session is closed
+func (s *Session) sendControl(frameType byte, id uint32, payload []byte) {
+	select {
+	case s.control <- controlFrame{frameType, id, payload}:
+	default:
+		s.closeWithError(errControlBacklog)
+	}
+}
+
+// controlLoop writes the frames queued by sendControl until the session is closed
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case frame := <-s.control:
+			if s.writeFrame(frame.frameType, frame.id, frame.payload) != nil {
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, frameHeaderLen)
+	for {
+		_, err := io.ReadFull(s.conn, header)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		payload := make([]byte, binary.BigEndian.Uint16(header[5:7]))
+		_, err = io.ReadFull(s.conn, payload)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+
+		err = s.handleFrame(frameType, id, payload)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(frameType byte, id uint32, payload []byte) error {
+	s.mutex.Lock()
+	stream := s.streams[id]
+	s.mutex.Unlock()
+
+	switch frameType {
+	case frameOpen:
+		if s.isClient {
+			return errNotClient
+		}
+		if stream != nil || len(payload) != 1 {
+			return errBadFrame
+		}
+		stream = newStream(s, id, payload[0])
+		s.mutex.Lock()
+		s.streams[id] = stream
+		s.mutex.Unlock()
+		select {
+		case s.accept <- stream:
+		default:
+			// Nobody is accepting, refuse rather than hold up the other streams
+			s.removeStream(id)
+			s.sendControl(frameClose, id, nil)
+		}
+	case frameData:
+		// The stream may have been closed on our side while this was in flight
+		if stream != nil {
+			return stream.receive(payload)
+		}
+	case frameClose:
+		if stream != nil {
+			s.removeStream(id)
+			stream.remoteClose()
+		}
+	case frameWindow:
+		if len(payload) != 4 {
+			return errBadFrame
+		}
+		if stream != nil {
+			stream.grow(binary.BigEndian.Uint32(payload))
+		}
+	case framePing:
+		s.sendControl(framePong, id, payload)
+	case framePong:
+	default:
+		return errBadFrame
+	}
+	return nil
+}
+
+func (s *Session) keepAliveLoop() {
+	ticker := time.NewTicker(s.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		lastRead := time.Unix(0, atomic.LoadInt64(&s.lastRead))
+		if time.Since(lastRead) > 3*s.keepAlive {
+			s.closeWithError(errTimeout)
+			return
+		}
+		s.sendControl(framePing, 0, nil)
+	}
+}
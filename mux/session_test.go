@@ -0,0 +1,249 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionPair is a client Session and the server Session at the other end
+func sessionPair(t *testing.T, keepAlive time.Duration) (*Session, *Session) {
+	c, s := net.Pipe()
+	client := Client(c, keepAlive)
+	server := Server(s, keepAlive)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// openPair opens a stream on client and accepts it on server
+func openPair(t *testing.T, client, server *Session) (*Stream, *Stream) {
+	opened, err := client.Open(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.Kind != 7 {
+		t.Fatalf("Accepted a stream of kind %v, opened %v", accepted.Kind, 7)
+	}
+	return opened, accepted
+}
+
+func TestWindowExhaustionAndResume(t *testing.T) {
+	client, server := sessionPair(t, 0)
+	opened, accepted := openPair(t, client, server)
+
+	sent := make([]byte, 3*initialWindow)
+	rand.Read(sent)
+	// Nothing is read yet, so the window runs out
+	opened.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := opened.Write(sent)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write past the window returned %v", err)
+	}
+	if n != initialWindow {
+		t.Fatalf("Wrote %v bytes before blocking, the window is %v", n, initialWindow)
+	}
+
+	// Reading opens the window again
+	opened.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := opened.Write(sent[n:])
+		opened.Close()
+		done <- err
+	}()
+	got, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Fatal("Got something else back")
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := sessionPair(t, 0)
+	opened, accepted := openPair(t, client, server)
+
+	opened.Write([]byte("last words"))
+	opened.Close()
+	got, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "last words" {
+		t.Fatalf("Got %q", got)
+	}
+	if _, err := accepted.Write([]byte("too late")); err != errStreamClosed {
+		t.Fatalf("Write after the other end closed returned %v", err)
+	}
+	if _, err := opened.Read(make([]byte, 1)); err != errStreamClosed {
+		t.Fatalf("Read after Close returned %v", err)
+	}
+	accepted.Close()
+
+	// The session carries on
+	opened, accepted = openPair(t, client, server)
+	go opened.Write([]byte("again"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "again" {
+		t.Fatalf("Got %q, %v on a new stream", buf, err)
+	}
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("Closing a stream closed the session")
+	}
+}
+
+func TestSessionCloseResetsStreams(t *testing.T) {
+	client, server := sessionPair(t, 0)
+	_, accepted := openPair(t, client, server)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := accepted.Read(make([]byte, 1))
+		done <- err
+	}()
+	client.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Read on a dead session succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still waiting after the session closed")
+	}
+	if _, err := client.Open(7); err != ErrSessionClosed {
+		t.Fatalf("Open on a closed session returned %v", err)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	keepAlive := 20 * time.Millisecond
+
+	// A peer that answers pings keeps the session up
+	client, _ := sessionPair(t, keepAlive)
+	time.Sleep(10 * keepAlive)
+	if client.IsClosed() {
+		t.Fatal("Session with an answering peer timed out")
+	}
+
+	// A peer that reads everything but never says anything doesn't
+	c, s := net.Pipe()
+	defer s.Close()
+	go io.Copy(io.Discard, s)
+	silent := Client(c, keepAlive)
+	defer silent.Close()
+	deadline := time.Now().Add(time.Second)
+	for !silent.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("Session with a silent peer never timed out")
+		}
+		time.Sleep(keepAlive)
+	}
+	if silent.closeErr != errTimeout {
+		t.Fatalf("Session closed with %v", silent.closeErr)
+	}
+}
+
+func TestPingFloodClosesSession(t *testing.T) {
+	// A peer that pings without ever reading the pongs
+	c, s := net.Pipe()
+	defer c.Close()
+	server := Server(s, 0)
+	defer server.Close()
+	ping := make([]byte, frameHeaderLen)
+	ping[0] = framePing
+	for i := 0; i < 2*controlBacklog; i++ {
+		if _, err := c.Write(ping); err != nil {
+			break
+		}
+	}
+	if !server.IsClosed() {
+		t.Fatal("Session took every ping without sending a pong")
+	}
+	if server.closeErr != errControlBacklog {
+		t.Fatalf("Session closed with %v", server.closeErr)
+	}
+}
+
+func TestControlFramesInOrder(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := Server(s, 0)
+	defer server.Close()
+	for i := uint32(0); i < 100; i++ {
+		server.sendControl(framePing, i, nil)
+	}
+	header := make([]byte, frameHeaderLen)
+	for i := uint32(0); i < 100; i++ {
+		if _, err := io.ReadFull(c, header); err != nil {
+			t.Fatal(err)
+		}
+		if id := binary.BigEndian.Uint32(header[1:5]); id != i {
+			t.Fatalf("Frame %v arrived as number %v", id, i)
+		}
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	client, server := sessionPair(t, 0)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.Open(0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+			sent := make([]byte, 100000)
+			rand.Read(sent)
+			go stream.Write(sent)
+			got := make([]byte, len(sent))
+			if _, err := io.ReadFull(stream, got); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, sent) {
+				errs <- errors.New("Stream got another stream's data")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,226 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a net.Conn carried by a Session
+type Stream struct {
+	id      uint32
+	session *Session
+	// Kind is what the client passed to Open
+	Kind byte
+
+	mutex sync.Mutex
+	// buf holds what has arrived but hasn't been read
+	buf []byte
+	// consumed is how much has been read since the last window update
+	consumed   uint32
+	sendWindow uint32
+	// closed is set when we close the stream, remoteClosed when the other end does
+	closed       bool
+	remoteClosed bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// readReady and writeReady wake up a Read or Write that is waiting
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newStream(session *Session, id uint32, kind byte) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		Kind:       kind,
+		sendWindow: initialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, the deadline passes or the session closes
+func (stream *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-stream.session.closed:
+		return stream.session.closeErr
+	}
+}
+
+// receive is called by the session when data arrives for the stream
+func (stream *Stream) receive(data []byte) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if len(stream.buf)+len(data) > initialWindow {
+		return errWindowExceeded
+	}
+	stream.buf = append(stream.buf, data...)
+	notify(stream.readReady)
+	return nil
+}
+
+// grow is called by the session when the other end lets us send more
+func (stream *Stream) grow(n uint32) {
+	stream.mutex.Lock()
+	stream.sendWindow += n
+	stream.mutex.Unlock()
+	notify(stream.writeReady)
+}
+
+// remoteClose is called by the session when the other end closes the stream
+func (stream *Stream) remoteClose() {
+	stream.mutex.Lock()
+	stream.remoteClosed = true
+	stream.mutex.Unlock()
+	notify(stream.readReady)
+	notify(stream.writeReady)
+}
+
+// Read reads what has arrived on the stream. It returns io.EOF once the
+// other end has closed the stream and everything it sent has been read
+func (stream *Stream) Read(b []byte) (n int, err error) {
+	for {
+		stream.mutex.Lock()
+		if stream.closed {
+			stream.mutex.Unlock()
+			return 0, errStreamClosed
+		}
+		if len(stream.buf) > 0 {
+			n = copy(b, stream.buf)
+			stream.buf = stream.buf[n:]
+			stream.consumed += uint32(n)
+			var update uint32
+			// Let the other end send more once half the window has been read
+			if stream.consumed >= initialWindow/2 && !stream.remoteClosed {
+				update = stream.consumed
+				stream.consumed = 0
+			}
+			stream.mutex.Unlock()
+			if update != 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, update)
+				stream.session.sendControl(frameWindow, stream.id, payload)
+			}
+			return n, nil
+		}
+		if stream.remoteClosed {
+			stream.mutex.Unlock()
+			return 0, io.EOF
+		}
+		deadline := stream.readDeadline
+		stream.mutex.Unlock()
+
+		err = stream.wait(stream.readReady, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b as data frames, waiting for the window to allow it
+func (stream *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		stream.mutex.Lock()
+		if stream.closed || stream.remoteClosed {
+			stream.mutex.Unlock()
+			return n, errStreamClosed
+		}
+		if stream.sendWindow == 0 {
+			deadline := stream.writeDeadline
+			stream.mutex.Unlock()
+			err = stream.wait(stream.writeReady, deadline)
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		chunk := b
+		if len(chunk) > maxFramePayload {
+			chunk = chunk[:maxFramePayload]
+		}
+		if uint32(len(chunk)) > stream.sendWindow {
+			chunk = chunk[:stream.sendWindow]
+		}
+		stream.sendWindow -= uint32(len(chunk))
+		stream.mutex.Unlock()
+
+		err = stream.session.writeFrame(frameData, stream.id, chunk)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close closes both directions of the stream. The session carries on
+func (stream *Stream) Close() error {
+	stream.mutex.Lock()
+	if stream.closed {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.closed = true
+	remoteClosed := stream.remoteClosed
+	stream.mutex.Unlock()
+	notify(stream.readReady)
+	notify(stream.writeReady)
+
+	stream.session.removeStream(stream.id)
+	if !remoteClosed {
+		stream.session.sendControl(frameClose, stream.id, nil)
+	}
+	return nil
+}
+
+func (stream *Stream) LocalAddr() net.Addr  { return stream.session.LocalAddr() }
+func (stream *Stream) RemoteAddr() net.Addr { return stream.session.RemoteAddr() }
+
+func (stream *Stream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+func (stream *Stream) SetReadDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.readDeadline = t
+	stream.mutex.Unlock()
+	notify(stream.readReady)
+	return nil
+}
+
+func (stream *Stream) SetWriteDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.writeDeadline = t
+	stream.mutex.Unlock()
+	notify(stream.writeReady)
+	return nil
+}
@@ -1,14 +1,21 @@
 package server
 
 import (
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
-	"time"
 )
 
 var u16 = binary.BigEndian.Uint16
 var u32 = binary.BigEndian.Uint32
 
+// Extension is an extension of a ClientHello
+type Extension struct {
+	Type [2]byte
+	Data []byte
+}
+
 // ClientHello contains every field in a ClientHello message
 type ClientHello struct {
 	handshakeType         byte
@@ -22,29 +29,140 @@ type ClientHello struct {
 	compressionMethodsLen int
 	compressionMethods    []byte
 	extensionsLen         int
-	extensions            map[[2]byte][]byte
+	// extensions are in the order the client sent them
+	extensions []Extension
+}
+
+// What can be wrong with a ClientHello, wrapped in a HelloError
+var (
+	ErrTruncated          = errors.New("truncated")
+	ErrLengthMismatch     = errors.New("length doesn't match")
+	ErrDuplicateExtension = errors.New("duplicate extension")
+	ErrNotClientHello     = errors.New("not a ClientHello")
+)
+
+// HelloError is returned by ParseClientHello. Field is the part of the
+// ClientHello that is wrong and Err is one of ErrTruncated,
+// ErrLengthMismatch, ErrDuplicateExtension or ErrNotClientHello
+type HelloError struct {
+	Field string
+	Err   error
 }
 
-func parseExtensions(input []byte) (ret map[[2]byte][]byte, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New("Malformed Extensions")
+func (e *HelloError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *HelloError) Unwrap() error {
+	return e.Err
+}
+
+// Random returns the random field of the ClientHello
+func (ch *ClientHello) Random() []byte {
+	return ch.random
+}
+
+// ServerName returns the host name in the server_name extension, or "" if
+// there isn't one
+func (ch *ClientHello) ServerName() string {
+	ext := ch.extension([2]byte{0x00, 0x00})
+	// server_name_list length (2), name_type (1), host_name length (2)
+	if len(ext) < 5 || int(u16(ext[0:2])) != len(ext)-2 || ext[2] != 0x00 {
+		return ""
+	}
+	length := int(u16(ext[3:5]))
+	if 5+length > len(ext) {
+		return ""
+	}
+	return string(ext[5 : 5+length])
+}
+
+// helloReader reads the fields of a ClientHello one after another, checking
+// that each is all there
+type helloReader struct {
+	data    []byte
+	pointer int
+}
+
+func (r *helloReader) left() int {
+	return len(r.data) - r.pointer
+}
+
+func (r *helloReader) read(n int, field string) ([]byte, error) {
+	if r.left() < n {
+		return nil, &HelloError{field, ErrTruncated}
+	}
+	ret := r.data[r.pointer : r.pointer+n]
+	r.pointer += n
+	return ret, nil
+}
+
+// readVector reads a field preceded by its length in lenBytes bytes
+func (r *helloReader) readVector(lenBytes int, field string) ([]byte, error) {
+	lenField, err := r.read(lenBytes, field+" length")
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for _, b := range lenField {
+		length = length<<8 | int(b)
+	}
+	return r.read(length, field)
+}
+
+// parseExtensions parses the extensions block of a ClientHello, keeping the
+// order they are in
+func parseExtensions(input []byte) ([]Extension, error) {
+	r := &helloReader{data: input}
+	var ret []Extension
+	seen := make(map[[2]byte]bool)
+	for r.left() > 0 {
+		typ, err := r.read(2, "extension type")
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.readVector(2, "extension")
+		if err != nil {
+			return nil, err
+		}
+		var ext Extension
+		copy(ext.Type[:], typ)
+		ext.Data = data
+		// Which of the two counts is undefined, so neither is accepted
+		if seen[ext.Type] {
+			return nil, &HelloError{"extension", ErrDuplicateExtension}
+		}
+		seen[ext.Type] = true
+		ret = append(ret, ext)
+	}
+	return ret, nil
+}
+
+// Extensions returns the extensions of the ClientHello in the order they
+// were sent
+func (ch *ClientHello) Extensions() []Extension {
+	return ch.extensions
+}
+
+// extension returns the data of the extension of typ, or nil if there isn't one
+func (ch *ClientHello) extension(typ [2]byte) []byte {
+	for _, ext := range ch.extensions {
+		if ext.Type == typ {
+			return ext.Data
 		}
-	}()
-	pointer := 0
-	totalLen := len(input)
-	ret = make(map[[2]byte][]byte)
-	for pointer < totalLen {
-		var typ [2]byte
-		copy(typ[:], input[pointer:pointer+2])
-		pointer += 2
-		length := int(u16(input[pointer : pointer+2]))
-		pointer += 2
-		data := input[pointer : pointer+length]
-		pointer += length
-		ret[typ] = data
-	}
-	return ret, err
+	}
+	return nil
+}
+
+// addExtRec adds type and length to extension data
+func addExtRec(typ []byte, data []byte) []byte {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(data)))
+	ret := make([]byte, 2+2+len(data))
+	copy(ret[0:2], typ)
+	copy(ret[2:4], length)
+	copy(ret[4:], data)
+	return ret
 }
 
 // AddRecordLayer adds record layer to data
@@ -65,100 +183,210 @@ func PeelRecordLayer(data []byte) []byte {
 	return ret
 }
 
-// ParseClientHello parses everything on top of the TLS layer
-// (including the record layer) into ClientHello type
-func ParseClientHello(data []byte) (ret *ClientHello, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New("Malformed ClientHello")
-		}
-	}()
-	data = PeelRecordLayer(data)
-	pointer := 0
+// ParseClientHello parses a ClientHello handshake message, reassembled from
+// its records by ReadClientHello, into ClientHello type. Errors are *HelloError
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	r := &helloReader{data: data}
 	// Handshake Type
-	handshakeType := data[pointer]
-	if handshakeType != 0x01 {
-		return ret, errors.New("Not a ClientHello")
+	handshakeType, err := r.read(1, "handshake type")
+	if err != nil {
+		return nil, err
+	}
+	if handshakeType[0] != 0x01 {
+		return nil, &HelloError{"handshake type", ErrNotClientHello}
 	}
-	pointer += 1
 	// Length
-	length := int(u32(append([]byte{0x00}, data[pointer:pointer+3]...)))
-	pointer += 3
-	if length != len(data[pointer:]) {
-		return ret, errors.New("Hello length doesn't match")
+	lengthField, err := r.read(3, "length")
+	if err != nil {
+		return nil, err
+	}
+	length := int(u32(append([]byte{0x00}, lengthField...)))
+	if length != r.left() {
+		return nil, &HelloError{"length", ErrLengthMismatch}
 	}
 	// Client Version
-	clientVersion := data[pointer : pointer+2]
-	pointer += 2
+	clientVersion, err := r.read(2, "client version")
+	if err != nil {
+		return nil, err
+	}
 	// Random
-	random := data[pointer : pointer+32]
-	pointer += 32
+	random, err := r.read(32, "random")
+	if err != nil {
+		return nil, err
+	}
 	// Session ID
-	sessionIdLen := int(data[pointer])
-	pointer += 1
-	sessionId := data[pointer : pointer+sessionIdLen]
-	pointer += sessionIdLen
+	sessionId, err := r.readVector(1, "session ID")
+	if err != nil {
+		return nil, err
+	}
 	// Cipher Suites
-	cipherSuitesLen := int(u16(data[pointer : pointer+2]))
-	pointer += 2
-	cipherSuites := data[pointer : pointer+cipherSuitesLen]
-	pointer += cipherSuitesLen
+	cipherSuites, err := r.readVector(2, "cipher suites")
+	if err != nil {
+		return nil, err
+	}
 	// Compression Methods
-	compressionMethodsLen := int(data[pointer])
-	pointer += 1
-	compressionMethods := data[pointer : pointer+compressionMethodsLen]
-	pointer += compressionMethodsLen
-	// Extensions
-	extensionsLen := int(u16(data[pointer : pointer+2]))
-	pointer += 2
-	extensions, err := parseExtensions(data[pointer:])
-	ret = &ClientHello{
-		handshakeType,
+	compressionMethods, err := r.readVector(1, "compression methods")
+	if err != nil {
+		return nil, err
+	}
+	// Extensions. A ClientHello may have none at all
+	var extensionsData []byte
+	if r.left() > 0 {
+		extensionsLen, err := r.read(2, "extensions length")
+		if err != nil {
+			return nil, err
+		}
+		if int(u16(extensionsLen)) != r.left() {
+			return nil, &HelloError{"extensions length", ErrLengthMismatch}
+		}
+		extensionsData, _ = r.read(r.left(), "extensions")
+	}
+	extensions, err := parseExtensions(extensionsData)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientHello{
+		handshakeType[0],
 		length,
 		clientVersion,
 		random,
-		sessionIdLen,
+		len(sessionId),
 		sessionId,
-		cipherSuitesLen,
+		len(cipherSuites),
 		cipherSuites,
-		compressionMethodsLen,
+		len(compressionMethods),
 		compressionMethods,
-		extensionsLen,
+		len(extensionsData),
 		extensions,
+	}, nil
+}
+
+func composeServerHello(ch *ClientHello, random []byte) []byte {
+	var serverHello [10][]byte
+	serverHello[0] = []byte{0x02}                         // handshake type
+	serverHello[1] = []byte{0x00, 0x00, 0x4d}             // length 77
+	serverHello[2] = []byte{0x03, 0x03}                   // server version
+	serverHello[3] = random                               // random
+	serverHello[4] = []byte{0x20}                         // session id length 32
+	serverHello[5] = ch.sessionId                         // session id
+	serverHello[6] = []byte{0xc0, 0x30}                   // cipher suite TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	serverHello[7] = []byte{0x00}                         // compression method null
+	serverHello[8] = []byte{0x00, 0x05}                   // extensions length 5
+	serverHello[9] = []byte{0xff, 0x01, 0x00, 0x01, 0x00} // extensions renegotiation_info
+	ret := []byte{}
+	for i := 0; i < 10; i++ {
+		ret = append(ret, serverHello[i]...)
+	}
+	return ret
+}
+
+// offersTLS13 checks if the ClientHello lists TLS 1.3 in supported_versions
+// and has an X25519 key share for us to answer with
+func (ch *ClientHello) offersTLS13() bool {
+	versions := ch.extension([2]byte{0x00, 0x2b})
+	if len(versions) < 1 || int(versions[0]) != len(versions)-1 {
+		return false
+	}
+	hasTLS13 := false
+	for i := 1; i+1 < len(versions); i += 2 {
+		if versions[i] == 0x03 && versions[i+1] == 0x04 {
+			hasTLS13 = true
+		}
+	}
+	if !hasTLS13 {
+		return false
+	}
+
+	keyShare := ch.extension([2]byte{0x00, 0x33})
+	if len(keyShare) < 2 || int(u16(keyShare[0:2])) != len(keyShare)-2 {
+		return false
+	}
+	for pointer := 2; pointer+4 <= len(keyShare); {
+		group := u16(keyShare[pointer : pointer+2])
+		length := int(u16(keyShare[pointer+2 : pointer+4]))
+		pointer += 4 + length
+		if group == 0x001d && length == 32 && pointer <= len(keyShare) {
+			return true
+		}
 	}
-	return
+	return false
 }
 
-func composeServerHello(ch *ClientHello) []byte {
+func composeServerHello13(ch *ClientHello, random []byte) []byte {
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	keyShare := append([]byte{0x00, 0x1d, 0x00, 0x20}, priv.PublicKey().Bytes()...)
+	var extensions []byte
+	extensions = append(extensions, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04)         // supported_versions TLS 1.3
+	extensions = append(extensions, addExtRec([]byte{0x00, 0x33}, keyShare)...) // key_share X25519
+
 	var serverHello [10][]byte
-	serverHello[0] = []byte{0x02}                              // handshake type
-	serverHello[1] = []byte{0x00, 0x00, 0x4d}                  // length 77
-	serverHello[2] = []byte{0x03, 0x03}                        // server version
-	serverHello[3] = PsudoRandBytes(32, time.Now().UnixNano()) // random
-	serverHello[4] = []byte{0x20}                              // session id length 32
-	serverHello[5] = ch.sessionId                              // session id
-	serverHello[6] = []byte{0xc0, 0x30}                        // cipher suite TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
-	serverHello[7] = []byte{0x00}                              // compression method null
-	serverHello[8] = []byte{0x00, 0x05}                        // extensions length 5
-	serverHello[9] = []byte{0xff, 0x01, 0x00, 0x01, 0x00}      // extensions renegotiation_info
+	serverHello[0] = []byte{0x02}                    // handshake type
+	serverHello[1] = make([]byte, 3)                 // length, filled in below
+	serverHello[2] = []byte{0x03, 0x03}              // legacy version
+	serverHello[3] = random                          // random
+	serverHello[4] = []byte{byte(len(ch.sessionId))} // session id length
+	serverHello[5] = ch.sessionId                    // legacy session id echo
+	serverHello[6] = []byte{0x13, 0x01}              // cipher suite TLS_AES_128_GCM_SHA256
+	serverHello[7] = []byte{0x00}                    // compression method null
+	serverHello[8] = make([]byte, 2)                 // extensions length
+	serverHello[9] = extensions                      // extensions
+	binary.BigEndian.PutUint16(serverHello[8], uint16(len(extensions)))
 	ret := []byte{}
 	for i := 0; i < 10; i++ {
 		ret = append(ret, serverHello[i]...)
 	}
+	length := len(ret) - 4
+	ret[1], ret[2], ret[3] = byte(length>>16), byte(length>>8), byte(length)
 	return ret
 }
 
-// ComposeReply composes the ServerHello, ChangeCipherSpec and Finished messages
-// together with their respective record layers into one byte slice. The content
-// of these messages are random and useless for this plugin
-func ComposeReply(ch *ClientHello) []byte {
+// composeReply13 composes a TLS 1.3 ServerHello, the middlebox compatibility
+// ChangeCipherSpec, and an application_data record as long as the encrypted
+// EncryptedExtensions, Certificate, CertificateVerify and Finished would be
+func composeReply13(ch *ClientHello, random []byte) []byte {
 	TLS12 := []byte{0x03, 0x03}
-	shBytes := AddRecordLayer(composeServerHello(ch), []byte{0x16}, TLS12)
+	shBytes := AddRecordLayer(composeServerHello13(ch, random), []byte{0x16}, TLS12)
 	ccsBytes := AddRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
-	finished := make([]byte, 64)
-	finished = PsudoRandBytes(40, time.Now().UnixNano())
-	fBytes := AddRecordLayer(finished, []byte{0x16}, TLS12)
+	// Certificate chains are usually 2 to 4.5 kB
+	flightLen := 2000 + int(u16(CryptoRandBytes(2)))%2500
+	flight := CryptoRandBytes(flightLen)
+	fBytes := AddRecordLayer(flight, []byte{0x17}, TLS12)
 	ret := append(shBytes, ccsBytes...)
 	ret = append(ret, fBytes...)
 	return ret
 }
+
+// ComposeReply composes the flights of records mq-server sends during the
+// handshake. The first is sent straight away and the second, if there is one,
+// after ReadClientReply. The content of these messages are random and useless
+// for this plugin.
+//
+// If shapes has a shape cloned from the web server for the version the
+// ClientHello offers, it is replayed. Otherwise the reply is ServerHello,
+// ChangeCipherSpec and Finished, and if the ClientHello offers TLS 1.3, a TLS
+// 1.3 ServerHello is sent instead and the Finished is replaced by the
+// encrypted handshake flight.
+//
+// Either way the server random tells the client, encrypted with key, how many
+// records each flight has
+func ComposeReply(ch *ClientHello, key []byte, shapes *Shapes) [][]byte {
+	tls13 := ch.offersTLS13()
+	if shape := shapes.Get(tls13); shape != nil {
+		flights, err := shape.replay(key, ch)
+		if err == nil {
+			return flights
+		}
+	}
+	random := makeServerRandom(key, ch.random, 3, 0, nil)
+	if tls13 {
+		return [][]byte{composeReply13(ch, random)}
+	}
+	TLS12 := []byte{0x03, 0x03}
+	shBytes := AddRecordLayer(composeServerHello(ch, random), []byte{0x16}, TLS12)
+	ccsBytes := AddRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
+	finished := CryptoRandBytes(40)
+	fBytes := AddRecordLayer(finished, []byte{0x16}, TLS12)
+	ret := append(shBytes, ccsBytes...)
+	ret = append(ret, fBytes...)
+	return [][]byte{ret}
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/client/TLS"
+	"github.com/cbeuw/masquerable/kdf"
+)
+
+// browserHello is a ClientHello, without record layer, as mq-client sends
+// it when mimicking browser
+func browserHello(t testing.TB, browser string, tls13 bool) []byte {
+	return browserHelloTo(t, browser, tls13, "www.example.com")
+}
+
+// browserHelloTo is browserHello with serverName in the SNI
+func browserHelloTo(t testing.TB, browser string, tls13 bool, serverName string) []byte {
+	sta := &client.State{
+		Now:            time.Now,
+		Key:            "test",
+		ServerName:     serverName,
+		Browser:        browser,
+		TLS13:          tls13,
+		TicketTimeHint: 3600,
+		KDF:            kdf.HKDF,
+	}
+	sta.SetKeys()
+	random := client.MakeRandomField(sta)
+	return TLS.PeelRecordLayer(TLS.ComposeInitHandshake(sta, random))
+}
+
+// goHello is the ClientHello of crypto/tls, without record layer
+func goHello(t testing.TB) []byte {
+	return goHelloWith(t, &tls.Config{ServerName: "www.example.com"})
+}
+
+// goHelloWith is the ClientHello of crypto/tls with config
+func goHelloWith(t testing.TB, config *tls.Config) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tls.Client(c, config).Handshake()
+		c.Close()
+	}()
+	_, hello, err := ReadClientHello(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
+
+func seedHellos(t testing.TB) map[string][]byte {
+	return map[string][]byte{
+		"chrome":   browserHello(t, "chrome", false),
+		"chrome13": browserHello(t, "chrome", true),
+		"firefox":  browserHello(t, "firefox", false),
+		"go":       goHello(t),
+	}
+}
+
+// setLength fixes the length in the handshake header of hello
+func setLength(hello []byte) []byte {
+	length := len(hello) - 4
+	hello[1], hello[2], hello[3] = byte(length>>16), byte(length>>8), byte(length)
+	return hello
+}
+
+// appendExtension adds an extension to the end of hello, fixing the lengths
+func appendExtension(hello []byte, typ [2]byte, data []byte) []byte {
+	ret := append([]byte{}, hello...)
+	ret = append(ret, addExtRec(typ[:], data)...)
+	ch, err := ParseClientHello(hello)
+	if err != nil {
+		panic(err)
+	}
+	// The extensions length is the 2 bytes before the extensions
+	extensionsLen := ch.extensionsLen + 4 + len(data)
+	at := len(hello) - ch.extensionsLen - 2
+	ret[at], ret[at+1] = byte(extensionsLen>>8), byte(extensionsLen)
+	return setLength(ret)
+}
+
+func TestParseClientHelloSeeds(t *testing.T) {
+	for name, hello := range seedHellos(t) {
+		ch, err := ParseClientHello(hello)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if ch.ServerName() != "www.example.com" {
+			t.Errorf("%v: server name %q", name, ch.ServerName())
+		}
+		if len(ch.Extensions()) == 0 {
+			t.Errorf("%v: no extensions", name)
+		}
+	}
+}
+
+func TestParseClientHelloKeepsOrder(t *testing.T) {
+	hello := browserHello(t, "firefox", false)
+	hello = appendExtension(hello, [2]byte{0xfe, 0x01}, []byte{0x01})
+	hello = appendExtension(hello, [2]byte{0xfe, 0x00}, []byte{0x02})
+	ch, err := ParseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extensions := ch.Extensions()
+	last := extensions[len(extensions)-2:]
+	if last[0].Type != [2]byte{0xfe, 0x01} || last[1].Type != [2]byte{0xfe, 0x00} {
+		t.Errorf("extensions out of order: %x %x", last[0].Type, last[1].Type)
+	}
+}
+
+func TestParseClientHelloErrors(t *testing.T) {
+	hello := browserHello(t, "chrome", false)
+	ch, err := ParseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extensionsAt := len(hello) - ch.extensionsLen - 2
+
+	badExtensionsLen := append([]byte{}, hello...)
+	badExtensionsLen[extensionsAt+1]++
+
+	// The first extension given again at the end
+	duplicate := appendExtension(hello, ch.extensions[0].Type, ch.extensions[0].Data)
+
+	cases := []struct {
+		name  string
+		hello []byte
+		want  error
+	}{
+		{"empty", []byte{}, ErrTruncated},
+		{"server hello", append([]byte{0x02}, hello[1:]...), ErrNotClientHello},
+		{"short length", hello[:len(hello)-1], ErrLengthMismatch},
+		{"cut in random", setLength(append([]byte{}, hello[:20]...)), ErrTruncated},
+		{"cut in cipher suites", setLength(append([]byte{}, hello[:4+2+32+1+32+2+3]...)), ErrTruncated},
+		{"extensions length", badExtensionsLen, ErrLengthMismatch},
+		{"cut in extension", setLength(append([]byte{}, hello[:extensionsAt+2+3]...)), ErrLengthMismatch},
+		{"duplicate extension", duplicate, ErrDuplicateExtension},
+	}
+	for _, c := range cases {
+		_, err := ParseClientHello(c.hello)
+		var helloErr *HelloError
+		if !errors.As(err, &helloErr) {
+			t.Errorf("%v: got %v, want a *HelloError", c.name, err)
+			continue
+		}
+		if !errors.Is(err, c.want) {
+			t.Errorf("%v: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	for _, hello := range seedHellos(f) {
+		f.Add(hello)
+	}
+	key := make([]byte, 32)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ch, err := ParseClientHello(data)
+		if err != nil {
+			var helloErr *HelloError
+			if !errors.As(err, &helloErr) {
+				t.Fatalf("error isn't a *HelloError: %v", err)
+			}
+			return
+		}
+		// Everything that was parsed must add up to the whole message
+		var extensions []byte
+		seen := make(map[[2]byte]bool)
+		for _, ext := range ch.Extensions() {
+			if seen[ext.Type] {
+				t.Fatalf("duplicate extension %x", ext.Type)
+			}
+			seen[ext.Type] = true
+			extensions = append(extensions, addExtRec(ext.Type[:], ext.Data)...)
+		}
+		if !bytes.HasSuffix(data, extensions) {
+			t.Fatal("extensions don't match the message")
+		}
+		if len(ch.random) != 32 {
+			t.Fatalf("random of %v bytes", len(ch.random))
+		}
+		// Nothing that looks at a parsed ClientHello may panic either
+		ch.ServerName()
+		ComposeReply(ch, key, nil)
+	})
+}
+
+func TestServerName(t *testing.T) {
+	for name, hello := range seedHellos(t) {
+		ch, err := ParseClientHello(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ch.ServerName(); got != "www.example.com" {
+			t.Errorf("%v: ServerName() = %q", name, got)
+		}
+	}
+
+	// Up to the longest a DNS name can be, past where padding stops
+	for _, length := range []int{1, 101, 102, 200, 253} {
+		serverName := strings.Repeat("a", length)
+		for _, b := range []struct {
+			browser string
+			tls13   bool
+		}{{"chrome", false}, {"chrome", true}, {"firefox", false}} {
+			hello := browserHelloTo(t, b.browser, b.tls13, serverName)
+			ch, err := ParseClientHello(hello)
+			if err != nil {
+				t.Fatalf("%v tls13 %v, %v byte name: %v", b.browser, b.tls13, length, err)
+			}
+			if got := ch.ServerName(); got != serverName {
+				t.Errorf("%v tls13 %v, %v byte name: ServerName() = %q", b.browser, b.tls13, length, got)
+			}
+			if b.browser == "chrome" && len(hello) < 512 {
+				t.Errorf("%v tls13 %v, %v byte name: not padded to 512 bytes, %v", b.browser, b.tls13, length, len(hello))
+			}
+		}
+	}
+
+	noSNI := goHelloWith(t, &tls.Config{InsecureSkipVerify: true})
+	sni := func(list []byte) []byte {
+		return append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)
+	}
+	cases := []struct {
+		name string
+		ext  []byte
+		want string
+	}{
+		{"valid", sni([]byte{0x00, 0x00, 0x03, 'a', '.', 'b'}), "a.b"},
+		{"wrong list length", append([]byte{0x00, 0x09}, 0x00, 0x00, 0x03, 'a', '.', 'b'), ""},
+		{"not a host_name", sni([]byte{0x01, 0x00, 0x03, 'a', '.', 'b'}), ""},
+		{"name past the end", sni([]byte{0x00, 0x00, 0x09, 'a', '.', 'b'}), ""},
+		{"too short", []byte{0x00, 0x01, 0x00}, ""},
+	}
+	ch, err := ParseClientHello(noSNI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ch.ServerName(); got != "" {
+		t.Errorf("No server_name: ServerName() = %q", got)
+	}
+	for _, c := range cases {
+		ch, err := ParseClientHello(appendExtension(noSNI, [2]byte{0x00, 0x00}, c.ext))
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if got := ch.ServerName(); got != c.want {
+			t.Errorf("%v: ServerName() = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
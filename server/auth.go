@@ -1,11 +1,14 @@
 package server
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha256"
+	"crypto/hmac"
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/cbeuw/masquerable/kdf"
 )
 
 func decrypt(iv []byte, key []byte, ciphertext []byte) []byte {
@@ -18,15 +21,45 @@ func decrypt(iv []byte, key []byte, ciphertext []byte) []byte {
 	return ret
 }
 
-// IsMq checks if a ClientHello belongs to a masquerable
-func IsMq(input *ClientHello, sta *State) bool {
-	var random [32]byte
-	copy(random[:], input.random)
+// ErrReplay is returned by IsMq when the random of a valid ClientHello has been seen before
+var ErrReplay = errors.New("random has been seen before")
+
+// IsMq checks if a ClientHello belongs to a masquerable and returns the user
+// it authenticates as and the keys it used, or nil if it doesn't.
+//
+// The encrypted half of the random field carries the client's timestamp
+// followed by a proof of the key, see kdf.Keys.Proof. It is decrypted with
+// the keys of each user, derived with each of sta.KDFs, in turn until the
+// proof matches. A ClientHello with a valid proof can still be rejected if
+// the timestamp is further than sta.MaxSkew away from our clock, or if its
+// random has been seen before. In those cases a non-nil error explains why
+func IsMq(input *ClientHello, sta *State) (*User, *kdf.Keys, error) {
+	for _, user := range sta.Users {
+		for _, kdfName := range sta.KDFs {
+			keys, err := sta.UserKeys(user, kdfName)
+			if err != nil {
+				continue
+			}
+			plaintext := decrypt(input.random[0:16], keys.Auth, input.random[16:])
+			timestamp := plaintext[0:4]
+			if !hmac.Equal(plaintext[4:], keys.Proof(timestamp)) {
+				continue
+			}
+
+			now := sta.Now()
+			skew := now.Sub(time.Unix(int64(u32(timestamp)), 0))
+			if skew < 0 {
+				skew = -skew
+			}
+			if skew > sta.MaxSkew {
+				return nil, nil, fmt.Errorf("clock of user %v is %v off, more than the allowed %v", user.Name, skew, sta.MaxSkew)
+			}
 
-	h := sha256.New()
-	t := int(sta.Now().Unix()) / (12 * 60 * 60)
-	h.Write([]byte(fmt.Sprintf("%v", t) + sta.Key))
-	goal := h.Sum(nil)[0:16]
-	plaintext := decrypt(input.random[0:16], sta.AESKey, input.random[16:])
-	return bytes.Equal(plaintext, goal)
+			if sta.Replay != nil && !sta.Replay.Add(input.random, now) {
+				return nil, nil, ErrReplay
+			}
+			return user, keys, nil
+		}
+	}
+	return nil, nil, nil
 }
@@ -0,0 +1,79 @@
+package server
+
+import "github.com/cbeuw/masquerable/internal/dest"
+
+// Backend is a Murmur server that tunnels can be passed to
+type Backend struct {
+	Name string
+	Addr string
+	// Users, if not empty, are the names of the only users routed to the
+	// backend
+	Users []string
+	// ServerNames, if not empty, are patterns of the server names routed to
+	// the backend, matched like the hosts in Targets
+	ServerNames []string
+}
+
+// general tells if the backend takes tunnels from anyone
+func (backend *Backend) general() bool {
+	return len(backend.Users) == 0 && len(backend.ServerNames) == 0
+}
+
+func (backend *Backend) hasUser(name string) bool {
+	for _, u := range backend.Users {
+		if u == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (backend *Backend) hasServerName(serverName string) bool {
+	if serverName == "" {
+		return false
+	}
+	for _, pattern := range backend.ServerNames {
+		if dest.MatchHost(pattern, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllBackends returns sta.Backends, or a single backend at MurmurAddr if
+// there are none
+func (sta *State) AllBackends() []*Backend {
+	if len(sta.Backends) == 0 {
+		return []*Backend{{Name: "murmur", Addr: sta.MurmurAddr}}
+	}
+	return sta.Backends
+}
+
+// Route returns the backends a tunnel of user, whose ClientHello named
+// serverName, may be passed to. They come in tiers to be tried in order:
+// the backends for serverName, then those for the user, then those for
+// anyone. Backends restricted to other users are in none of them. Empty
+// tiers are left out
+func (sta *State) Route(user *User, serverName string) [][]*Backend {
+	var byServerName, byUser, general []*Backend
+	for _, backend := range sta.AllBackends() {
+		if len(backend.Users) != 0 && !backend.hasUser(user.Name) {
+			continue
+		}
+		switch {
+		case backend.hasServerName(serverName):
+			byServerName = append(byServerName, backend)
+		case backend.hasUser(user.Name):
+			byUser = append(byUser, backend)
+		case backend.general():
+			general = append(general, backend)
+		}
+	}
+	var tiers [][]*Backend
+	for _, tier := range [][]*Backend{byServerName, byUser, general} {
+		if len(tier) != 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
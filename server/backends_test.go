@@ -0,0 +1,74 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+// names lists the names of each tier
+func names(tiers [][]*Backend) [][]string {
+	var ret [][]string
+	for _, tier := range tiers {
+		var tierNames []string
+		for _, backend := range tier {
+			tierNames = append(tierNames, backend.Name)
+		}
+		ret = append(ret, tierNames)
+	}
+	return ret
+}
+
+func TestRoute(t *testing.T) {
+	sta := &State{
+		Backends: []*Backend{
+			{Name: "general1", Addr: "127.0.0.1:1"},
+			{Name: "alice", Addr: "127.0.0.1:2", Users: []string{"alice"}},
+			{Name: "voice", Addr: "127.0.0.1:3", ServerNames: []string{"*.voice.example.com"}},
+			{Name: "general2", Addr: "127.0.0.1:4"},
+			{Name: "both", Addr: "127.0.0.1:5", Users: []string{"bob"}, ServerNames: []string{"bob.example.com"}},
+			{Name: "dave", Addr: "127.0.0.1:6", Users: []string{"dave"}, ServerNames: []string{"*.voice.example.com"}},
+		},
+	}
+	alice := &User{Name: "alice"}
+	bob := &User{Name: "bob"}
+	carol := &User{Name: "carol"}
+	dave := &User{Name: "dave"}
+	cases := []struct {
+		user       *User
+		serverName string
+		want       [][]string
+	}{
+		{carol, "", [][]string{{"general1", "general2"}}},
+		{alice, "", [][]string{{"alice"}, {"general1", "general2"}}},
+		{alice, "eu.voice.example.com", [][]string{{"voice"}, {"alice"}, {"general1", "general2"}}},
+		{carol, "EU.Voice.Example.com", [][]string{{"voice"}, {"general1", "general2"}}},
+		{carol, "voice.example.com", [][]string{{"general1", "general2"}}},
+		{bob, "", [][]string{{"both"}, {"general1", "general2"}}},
+		// Backends for other users are passed over, whatever the server name
+		{carol, "bob.example.com", [][]string{{"general1", "general2"}}},
+		{alice, "bob.example.com", [][]string{{"alice"}, {"general1", "general2"}}},
+		{dave, "eu.voice.example.com", [][]string{{"voice", "dave"}, {"general1", "general2"}}},
+		{dave, "", [][]string{{"dave"}, {"general1", "general2"}}},
+		// A backend is only in its first tier
+		{bob, "bob.example.com", [][]string{{"both"}, {"general1", "general2"}}},
+	}
+	for _, c := range cases {
+		if got := names(sta.Route(c.user, c.serverName)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Route(%v, %q) = %v, want %v", c.user.Name, c.serverName, got, c.want)
+		}
+	}
+}
+
+func TestRouteWithoutBackends(t *testing.T) {
+	sta := &State{MurmurAddr: "127.0.0.1:64738"}
+	tiers := sta.Route(&User{Name: "alice"}, "www.example.com")
+	if len(tiers) != 1 || len(tiers[0]) != 1 || tiers[0][0].Addr != sta.MurmurAddr {
+		t.Fatalf("Route without Backends = %v", names(tiers))
+	}
+
+	// Specific backends alone leave other users with nowhere to go
+	sta.Backends = []*Backend{{Name: "alice", Addr: "127.0.0.1:1", Users: []string{"alice"}}}
+	if tiers := sta.Route(&User{Name: "bob"}, ""); len(tiers) != 0 {
+		t.Fatalf("bob routed to %v", names(tiers))
+	}
+}
@@ -0,0 +1,459 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// record is a TLS record as the redirection server sent it
+type record struct {
+	typ     byte
+	payload []byte
+}
+
+// Shape is how the redirection server's side of a handshake looked, so that
+// it can be replayed to mq-client with fresh randoms and keys.
+//
+// Flights are the records the server sent each time before the client
+// answered. A TLS 1.2 handshake has two, ending in ServerHelloDone and in
+// Finished. A TLS 1.3 one has the encrypted handshake and then, usually, the
+// tickets sent once the client has finished
+type Shape struct {
+	TLS13   bool
+	flights [][]record
+	// sentinel is the downgrade sentinel at the end of the recorded server
+	// random, if it had one
+	sentinel []byte
+}
+
+// flightRecorder keeps everything read from a connection, starting a new
+// flight whenever something is written after something has been read
+type flightRecorder struct {
+	net.Conn
+	flights [][]byte
+	reading bool
+}
+
+func (r *flightRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		if !r.reading {
+			r.flights = append(r.flights, nil)
+			r.reading = true
+		}
+		last := len(r.flights) - 1
+		r.flights[last] = append(r.flights[last], b[:n]...)
+	}
+	return n, err
+}
+
+func (r *flightRecorder) Write(b []byte) (int, error) {
+	r.reading = false
+	return r.Conn.Write(b)
+}
+
+// splitRecords splits data into records. An incomplete record at the end is
+// left out
+func splitRecords(data []byte) []record {
+	var records []record
+	for len(data) >= 5 {
+		length := int(u16(data[3:5]))
+		if len(data) < 5+length {
+			break
+		}
+		records = append(records, record{data[0], data[5 : 5+length]})
+		data = data[5+length:]
+	}
+	return records
+}
+
+// CloneHandshake does a real TLS handshake with the web server at addr,
+// asking for serverName and for TLS 1.3 if tls13, and records the shape of
+// what the server sent. The certificate isn't checked
+func CloneHandshake(addr string, serverName string, tls13 bool, timeout time.Duration) (*Shape, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	recorder := &flightRecorder{Conn: conn}
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		// Browsers ask for these, and servers answer differently if they don't
+		NextProtos: []string{"h2", "http/1.1"},
+		// Without a cache crypto/tls offers neither session tickets nor, in
+		// TLS 1.3, psk_key_exchange_modes, and servers don't send tickets
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		// The groups mq-client has key shares for
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		MinVersion:       tls.VersionTLS12,
+		MaxVersion:       tls.VersionTLS12,
+	}
+	if tls13 {
+		config.MinVersion = tls.VersionTLS13
+		config.MaxVersion = tls.VersionTLS13
+	}
+	tlsConn := tls.Client(recorder, config)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	if tls13 {
+		// Wait for the tickets, which come after the handshake
+		tlsConn.SetReadDeadline(time.Now().Add(time.Second))
+		tlsConn.Read(make([]byte, 1))
+	}
+
+	shape := &Shape{TLS13: tls13}
+	for _, flight := range recorder.flights {
+		shape.flights = append(shape.flights, splitRecords(flight))
+	}
+	if len(shape.flights) == 0 || len(shape.flights[0]) == 0 || len(shape.flights[0][0].payload) == 0 ||
+		shape.flights[0][0].typ != 0x16 || shape.flights[0][0].payload[0] != 0x02 {
+		return nil, errors.New("Cloning handshake: the server didn't start with a ServerHello")
+	}
+	if len(shape.flights) > 2 || len(shape.flights[0]) > 255 || len(shape.flights[len(shape.flights)-1]) > 255 {
+		return nil, errors.New("Cloning handshake: too many records")
+	}
+	// handshake header, version and random
+	serverHello := shape.flights[0][0].payload
+	if !tls13 && len(serverHello) >= 4+2+32 {
+		shape.sentinel = downgradeSentinel(serverHello[4+2 : 4+2+32])
+	}
+	return shape, nil
+}
+
+// NumFlights is how many flights the server sent before application data
+func (shape *Shape) NumFlights() int {
+	return len(shape.flights)
+}
+
+// Shapes holds the latest shapes cloned from the redirection server. It is
+// safe for concurrent use
+type Shapes struct {
+	tls12 atomic.Pointer[Shape]
+	tls13 atomic.Pointer[Shape]
+}
+
+// Set replaces the shape for shape.TLS13
+func (s *Shapes) Set(shape *Shape) {
+	if shape.TLS13 {
+		s.tls13.Store(shape)
+	} else {
+		s.tls12.Store(shape)
+	}
+}
+
+// Clear forgets both shapes, so that the fixed handshake is used
+func (s *Shapes) Clear() {
+	s.tls12.Store(nil)
+	s.tls13.Store(nil)
+}
+
+// Get returns the shape for TLS 1.3 or 1.2, or nil if there isn't one
+func (s *Shapes) Get(tls13 bool) *Shape {
+	if s == nil {
+		return nil
+	}
+	if tls13 {
+		return s.tls13.Load()
+	}
+	return s.tls12.Load()
+}
+
+// The endings of the random of a TLS 1.2 and of a TLS 1.1 ServerHello from
+// a server that can do TLS 1.3, RFC 8446 section 4.1.3
+var downgradeSentinels = [][]byte{
+	[]byte("DOWNGRD\x01"),
+	[]byte("DOWNGRD\x00"),
+}
+
+// downgradeSentinel returns the downgrade sentinel random ends in, or nil
+func downgradeSentinel(random []byte) []byte {
+	for _, sentinel := range downgradeSentinels {
+		if bytes.Equal(random[32-len(sentinel):], sentinel) {
+			return sentinel
+		}
+	}
+	return nil
+}
+
+// flightMask hides the number of records in each flight, which are put in
+// the server random after the bytes it's made from. Only someone with the
+// key can read them
+func flightMask(key []byte, clientRandom []byte, serverRandom []byte) [2]byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write(clientRandom)
+	h.Write(serverRandom)
+	var mask [2]byte
+	copy(mask[:], h.Sum(nil))
+	return mask
+}
+
+// makeServerRandom makes a server random that tells the client how many
+// records are in the first and the second flight. They go in the last two
+// bytes, after 30 random ones.
+//
+// If sentinel isn't nil the random ends in it, as the web server's does, and
+// the flight lengths go just before it. That leaves 22 random bytes, which is
+// still far too many to repeat or guess
+func makeServerRandom(key []byte, clientRandom []byte, first int, second int, sentinel []byte) []byte {
+	random := CryptoRandBytes(32)
+	at := 30
+	if sentinel != nil {
+		at = 32 - len(sentinel) - 2
+		copy(random[at+2:], sentinel)
+	}
+	mask := flightMask(key, clientRandom, random[:at])
+	random[at] = byte(first) ^ mask[0]
+	random[at+1] = byte(second) ^ mask[1]
+	return random
+}
+
+// ecdhCurves are the groups whose keys can be made for real. Keys for other
+// groups are random bytes of the same length
+var ecdhCurves = map[uint16]ecdh.Curve{
+	0x0017: ecdh.P256(),
+	0x0018: ecdh.P384(),
+	0x0019: ecdh.P521(),
+	0x001d: ecdh.X25519(),
+}
+
+// makeKeyExchange makes a public key of group that is length bytes long
+func makeKeyExchange(group uint16, length int) []byte {
+	if curve, ok := ecdhCurves[group]; ok {
+		priv, err := curve.GenerateKey(rand.Reader)
+		if err == nil && len(priv.PublicKey().Bytes()) == length {
+			return priv.PublicKey().Bytes()
+		}
+	}
+	ret := make([]byte, length)
+	rand.Read(ret)
+	return ret
+}
+
+// rewriteServerHello gives the body of a recorded ServerHello a new random,
+// session ID and key share
+func rewriteServerHello(body []byte, random []byte, ch *ClientHello, tls13 bool) ([]byte, error) {
+	// version, random, session ID length
+	if len(body) < 2+32+1 {
+		return nil, errors.New("Short ServerHello")
+	}
+	ret := append([]byte{}, body[:2]...)
+	ret = append(ret, random...)
+	pointer := 2 + 32
+	sessionIdLen := int(body[pointer])
+	pointer += 1 + sessionIdLen
+	if tls13 {
+		// The client's legacy session ID is echoed
+		ret = append(ret, byte(len(ch.sessionId)))
+		ret = append(ret, ch.sessionId...)
+	} else {
+		ret = append(ret, byte(sessionIdLen))
+		ret = append(ret, CryptoRandBytes(sessionIdLen)...)
+	}
+	// cipher suite, compression method, extensions length
+	if len(body) < pointer+2+1+2 {
+		return nil, errors.New("Short ServerHello")
+	}
+	ret = append(ret, body[pointer:pointer+3]...)
+	pointer += 3
+	extensionsLen := int(u16(body[pointer : pointer+2]))
+	pointer += 2
+	if len(body) != pointer+extensionsLen {
+		return nil, errors.New("ServerHello extensions length doesn't match")
+	}
+	var extensions []byte
+	for pointer < len(body) {
+		if len(body) < pointer+4 {
+			return nil, errors.New("Malformed ServerHello extensions")
+		}
+		typ := body[pointer : pointer+2]
+		length := int(u16(body[pointer+2 : pointer+4]))
+		pointer += 4
+		if len(body) < pointer+length {
+			return nil, errors.New("Malformed ServerHello extensions")
+		}
+		data := body[pointer : pointer+length]
+		pointer += length
+		// key_share: group, key length, key
+		if typ[0] == 0x00 && typ[1] == 0x33 && len(data) >= 4 && int(u16(data[2:4])) == len(data)-4 {
+			group := u16(data[0:2])
+			data = append(append([]byte{}, data[:4]...), makeKeyExchange(group, len(data)-4)...)
+		}
+		extensions = append(extensions, addExtRec(typ, data)...)
+	}
+	ret = append(ret, byte(len(extensions)>>8), byte(len(extensions)))
+	ret = append(ret, extensions...)
+	return ret, nil
+}
+
+// rewriteKeyExchange gives the body of a recorded ServerKeyExchange a new
+// key and a signature of random bytes
+func rewriteKeyExchange(body []byte) []byte {
+	// curve type named_curve, curve, key length
+	if len(body) < 4 || body[0] != 0x03 || len(body) < 4+int(body[3]) {
+		return CryptoRandBytes(len(body))
+	}
+	keyLen := int(body[3])
+	ret := append([]byte{}, body[:4]...)
+	ret = append(ret, makeKeyExchange(u16(body[1:3]), keyLen)...)
+	rest := body[4+keyLen:]
+	// signature algorithm, signature length, signature
+	if len(rest) < 4 || len(rest) != 4+int(u16(rest[2:4])) {
+		return append(ret, CryptoRandBytes(len(rest))...)
+	}
+	ret = append(ret, rest[:4]...)
+	return append(ret, CryptoRandBytes(len(rest)-4)...)
+}
+
+// rewriteTicket gives the body of a recorded NewSessionTicket a new ticket
+func rewriteTicket(body []byte) []byte {
+	if len(body) < 6 {
+		return CryptoRandBytes(len(body))
+	}
+	ret := append([]byte{}, body[:6]...)
+	return append(ret, CryptoRandBytes(len(body)-6)...)
+}
+
+// rewriteHandshake rewrites the handshake messages in data, the payloads of
+// consecutive plaintext handshake records. Certificates and the like are
+// kept as they are
+func rewriteHandshake(data []byte, random []byte, ch *ClientHello, tls13 bool) ([]byte, error) {
+	var ret []byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("Malformed handshake message")
+		}
+		typ := data[0]
+		length := int(u32(append([]byte{0x00}, data[1:4]...)))
+		if len(data) < 4+length {
+			return nil, errors.New("Malformed handshake message")
+		}
+		body := data[4 : 4+length]
+		data = data[4+length:]
+		switch typ {
+		case 0x02:
+			var err error
+			body, err = rewriteServerHello(body, random, ch, tls13)
+			if err != nil {
+				return nil, err
+			}
+		case 0x0c:
+			body = rewriteKeyExchange(body)
+		case 0x04:
+			body = rewriteTicket(body)
+		}
+		ret = append(ret, typ, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+		ret = append(ret, body...)
+	}
+	return ret, nil
+}
+
+// replayFlight makes a flight like records. Plaintext handshake messages are
+// rewritten and encrypted records are replaced by random bytes of the same
+// length. Records keep their lengths, except where a rewritten ServerHello
+// is of a different length
+func replayFlight(records []record, random []byte, ch *ClientHello, tls13 bool) ([]byte, error) {
+	TLS12 := []byte{0x03, 0x03}
+	var ret []byte
+	// In TLS 1.2 everything after ChangeCipherSpec is encrypted.
+	// In TLS 1.3 encrypted records are application_data
+	encrypted := false
+	for i := 0; i < len(records); {
+		rec := records[i]
+		switch {
+		case rec.typ == 0x14:
+			ret = append(ret, AddRecordLayer(rec.payload, []byte{0x14}, TLS12)...)
+			encrypted = !tls13
+			i++
+		case rec.typ == 0x16 && !encrypted:
+			// A handshake message can be split across records, so the run of
+			// handshake records is rewritten together and split up again
+			var run []record
+			var data []byte
+			for ; i < len(records) && records[i].typ == 0x16; i++ {
+				run = append(run, records[i])
+				data = append(data, records[i].payload...)
+			}
+			data, err := rewriteHandshake(data, random, ch, tls13)
+			if err != nil {
+				return nil, err
+			}
+			for j, r := range run {
+				length := len(r.payload)
+				if j == len(run)-1 || length > len(data) {
+					length = len(data)
+				}
+				ret = append(ret, AddRecordLayer(data[:length], []byte{0x16}, TLS12)...)
+				data = data[length:]
+			}
+		default:
+			ret = append(ret, AddRecordLayer(CryptoRandBytes(len(rec.payload)), []byte{rec.typ}, TLS12)...)
+			i++
+		}
+	}
+	return ret, nil
+}
+
+// replay makes the flights of shape for a client that sent ch
+func (shape *Shape) replay(key []byte, ch *ClientHello) ([][]byte, error) {
+	second := 0
+	if len(shape.flights) > 1 {
+		second = len(shape.flights[1])
+	}
+	random := makeServerRandom(key, ch.random, len(shape.flights[0]), second, shape.sentinel)
+	var ret [][]byte
+	for _, records := range shape.flights {
+		flight, err := replayFlight(records, random, ch, shape.TLS13)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, flight)
+	}
+	return ret, nil
+}
+
+// ReadClientReply reads the client's answer to the first flight, up to and
+// including the record after ChangeCipherSpec
+func ReadClientReply(conn net.Conn) error {
+	buf := make([]byte, 5+16384+256)
+	// ClientKeyExchange, ChangeCipherSpec and Finished at the most
+	for c := 0; c < 3; c++ {
+		i, err := ReadTLS(conn, buf)
+		if err != nil {
+			return err
+		}
+		if i > 0 && buf[0] == 0x14 {
+			_, err = ReadTLS(conn, buf)
+			return err
+		}
+	}
+	return errors.New("No ChangeCipherSpec from the client")
+}
+
+// CloneShapes clones the TLS 1.2 and 1.3 handshakes of sta.RedirAddr into
+// shapes. A shape that can't be cloned is left as it was
+func CloneShapes(sta *State, shapes *Shapes) error {
+	var errs []error
+	for _, tls13 := range []bool{false, true} {
+		shape, err := CloneHandshake(sta.RedirAddr, sta.CloneServerName, tls13, sta.DialTimeout)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		shapes.Set(shape)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cbeuw/masquerable/client/TLS"
+)
+
+func TestServerRandomFlightLengths(t *testing.T) {
+	key := []byte("key")
+	clientRandom := CryptoRandBytes(32)
+	for _, sentinel := range append([][]byte{nil}, downgradeSentinels...) {
+		for _, lengths := range [][2]int{{1, 0}, {3, 0}, {7, 2}, {255, 255}} {
+			random := makeServerRandom(key, clientRandom, lengths[0], lengths[1], sentinel)
+			if sentinel != nil && !bytes.HasSuffix(random, sentinel) {
+				t.Fatalf("Random %x lost the sentinel %q", random, sentinel)
+			}
+			// record layer, handshake header and version
+			serverHello := append([]byte{0x16, 0x03, 0x03, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x03, 0x03}, random...)
+			first, second, err := TLS.FlightLengths(key, clientRandom, serverHello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first != lengths[0] || second != lengths[1] {
+				t.Errorf("Sentinel %q: read %v and %v, wrote %v", sentinel, first, second, lengths)
+			}
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/cbeuw/masquerable/internal/config"
+	"github.com/cbeuw/masquerable/internal/dest"
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// KeyEnv is the environment variable the key can be read from, so that it
+// doesn't show up in ps or shell history
+const KeyEnv = "MQ_KEY"
+
+type rawUser struct {
+	Name string
+	Key  string
+}
+
+type rawNetwork struct {
+	Name string
+	CIDR string
+}
+
+// rawConfig is how the config file looks. Durations are strings like "5m"
+type rawConfig struct {
+	BindAddr            string
+	RedirAddr           string
+	MurmurAddr          string
+	Backends            []*Backend
+	Key                 string
+	KeyFile             string
+	UsersFile           string
+	Users               []rawUser
+	KDFs                []string
+	KeySalt             string
+	MaxSkew             string
+	HandshakeTimeout    string
+	DrainTimeout        string
+	DialTimeout         string
+	HealthCheckInterval string
+	KeepAlive           string
+	CloneServerName     string
+	CloneInterval       string
+	Padding             string
+	Shaping             string
+	ShapingLatency      string
+	ShapingOverhead     *int
+	MetricsAddr         string
+	Networks            []rawNetwork
+	Targets             map[string][]string
+	Verbose             *bool
+}
+
+// ParseConfig reads a JSON config file into sta. Anything the file leaves
+// out is left as it is.
+//
+// Users can be given in Users, in a users file (see LoadUsers) with UsersFile,
+// or as a single key with Key or KeyFile. Users and UsersFile can be used together
+func (sta *State) ParseConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw rawConfig
+	// Catch misspelt fields rather than silently ignoring them
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	if raw.BindAddr != "" {
+		sta.BindAddr = raw.BindAddr
+	}
+	if raw.RedirAddr != "" {
+		sta.RedirAddr = raw.RedirAddr
+	}
+	if raw.MurmurAddr != "" {
+		sta.MurmurAddr = raw.MurmurAddr
+	}
+	if raw.Backends != nil {
+		sta.Backends = raw.Backends
+	}
+	if raw.KDFs != nil {
+		sta.KDFs = raw.KDFs
+	}
+	if raw.KeySalt != "" {
+		sta.KeySalt = raw.KeySalt
+	}
+	if raw.CloneServerName != "" {
+		sta.CloneServerName = raw.CloneServerName
+	}
+	if raw.Padding != "" {
+		sta.Padding = raw.Padding
+	}
+	if raw.Shaping != "" {
+		sta.Shaping = raw.Shaping
+	}
+	if raw.ShapingOverhead != nil {
+		sta.ShapingOverhead = *raw.ShapingOverhead
+	}
+	if raw.MetricsAddr != "" {
+		sta.MetricsAddr = raw.MetricsAddr
+	}
+	if raw.Networks != nil {
+		sta.Networks = nil
+		for _, n := range raw.Networks {
+			if n.Name == "" {
+				return errors.New("Networks: every network must have a Name")
+			}
+			_, ipNet, err := net.ParseCIDR(n.CIDR)
+			if err != nil {
+				return fmt.Errorf("Networks: %v: %v", n.Name, err)
+			}
+			sta.Networks = append(sta.Networks, Network{n.Name, ipNet})
+		}
+	}
+	if raw.Targets != nil {
+		sta.Targets = raw.Targets
+	}
+	if raw.Verbose != nil {
+		sta.Verbose = *raw.Verbose
+	}
+	err = config.ParseDuration("MaxSkew", raw.MaxSkew, &sta.MaxSkew)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("HandshakeTimeout", raw.HandshakeTimeout, &sta.HandshakeTimeout)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("DrainTimeout", raw.DrainTimeout, &sta.DrainTimeout)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("DialTimeout", raw.DialTimeout, &sta.DialTimeout)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("HealthCheckInterval", raw.HealthCheckInterval, &sta.HealthCheckInterval)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("CloneInterval", raw.CloneInterval, &sta.CloneInterval)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("KeepAlive", raw.KeepAlive, &sta.KeepAlive)
+	if err != nil {
+		return err
+	}
+	err = config.ParseDuration("ShapingLatency", raw.ShapingLatency, &sta.ShapingLatency)
+	if err != nil {
+		return err
+	}
+
+	var users []*User
+	if raw.UsersFile != "" {
+		users, err = LoadUsers(raw.UsersFile)
+		if err != nil {
+			return err
+		}
+	}
+	for _, u := range raw.Users {
+		if u.Name == "" || u.Key == "" {
+			return errors.New("Users: every user must have a Name and a Key")
+		}
+		users = append(users, NewUser(u.Name, u.Key))
+	}
+	if len(users) == 0 {
+		key := raw.Key
+		if raw.KeyFile != "" {
+			key, err = config.ReadKeyFile(raw.KeyFile)
+			if err != nil {
+				return err
+			}
+		}
+		if key != "" {
+			users = []*User{NewUser("default", key)}
+		}
+	}
+	if len(users) != 0 {
+		sta.Users = users
+	}
+	return nil
+}
+
+// Validate checks that sta is complete and makes sense
+func (sta *State) Validate() error {
+	if sta.RedirAddr == "" {
+		return errors.New("Must specify RedirAddr")
+	}
+	addrs := map[string]string{
+		"BindAddr":  sta.BindAddr,
+		"RedirAddr": sta.RedirAddr,
+	}
+	// MurmurAddr isn't used when there are Backends
+	if len(sta.Backends) == 0 {
+		addrs["MurmurAddr"] = sta.MurmurAddr
+	}
+	if sta.MetricsAddr != "" {
+		addrs["MetricsAddr"] = sta.MetricsAddr
+	}
+	for name, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	if sta.MaxSkew <= 0 {
+		return errors.New("MaxSkew must be positive")
+	}
+	if sta.HandshakeTimeout <= 0 {
+		return errors.New("HandshakeTimeout must be positive")
+	}
+	if sta.DrainTimeout < 0 {
+		return errors.New("DrainTimeout must not be negative")
+	}
+	if sta.DialTimeout <= 0 {
+		return errors.New("DialTimeout must be positive")
+	}
+	if sta.HealthCheckInterval <= 0 {
+		return errors.New("HealthCheckInterval must be positive")
+	}
+	if sta.CloneInterval < 0 {
+		return errors.New("CloneInterval must not be negative")
+	}
+	if sta.KeepAlive < 0 {
+		return errors.New("KeepAlive must not be negative")
+	}
+	if _, err := tunnel.ParsePadding(sta.Padding); err != nil {
+		return err
+	}
+	if err := sta.TunnelShaping().Validate(); err != nil {
+		return err
+	}
+	if len(sta.Users) == 0 {
+		return errors.New("No users")
+	}
+	if len(sta.KDFs) == 0 {
+		return errors.New("No KDFs")
+	}
+	kdfs := make(map[string]bool)
+	for _, kdfName := range sta.KDFs {
+		if err := kdf.Check(kdfName, sta.KeySalt); err != nil {
+			return err
+		}
+		if kdfs[kdfName] {
+			return errors.New("Duplicate KDF " + kdfName)
+		}
+		kdfs[kdfName] = true
+	}
+	names := make(map[string]bool)
+	for _, user := range sta.Users {
+		if names[user.Name] {
+			return errors.New("Duplicate user " + user.Name)
+		}
+		names[user.Name] = true
+	}
+	backendNames := make(map[string]bool)
+	for _, backend := range sta.Backends {
+		if backend.Name == "" {
+			return errors.New("Backends: every backend must have a Name")
+		}
+		if backendNames[backend.Name] {
+			return errors.New("Backends: duplicate backend " + backend.Name)
+		}
+		backendNames[backend.Name] = true
+		if _, _, err := net.SplitHostPort(backend.Addr); err != nil {
+			return fmt.Errorf("Backends: %v: %v", backend.Name, err)
+		}
+		for _, name := range backend.Users {
+			if !names[name] {
+				return fmt.Errorf("Backends: %v: no user called %v", backend.Name, name)
+			}
+		}
+	}
+	for name, patterns := range sta.Targets {
+		if name != AllUsers && !names[name] {
+			return fmt.Errorf("Targets: no user called %v", name)
+		}
+		for _, pattern := range patterns {
+			if err := dest.CheckPattern(pattern); err != nil {
+				return fmt.Errorf("Targets: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net"
+)
+
+// Network names a range of client addresses, so that metrics can tell
+// where connections come from
+type Network struct {
+	Name  string
+	IPNet *net.IPNet
+}
+
+// NetworkOf returns the name of the first of sta.Networks that addr is in.
+// Addresses that aren't in any of them are "loopback", "private" or "public"
+func (sta *State) NetworkOf(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return "unknown"
+	}
+	for _, network := range sta.Networks {
+		if network.IPNet.Contains(ip) {
+			return network.Name
+		}
+	}
+	switch {
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsPrivate():
+		return "private"
+	default:
+		return "public"
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+type replayEntry struct {
+	random [32]byte
+	added  time.Time
+	// ttl is the TTL in force when the entry was added
+	ttl time.Duration
+}
+
+// ReplayCache remembers the randoms of ClientHellos that have passed
+// authentication, so that a captured handshake cannot be used again
+// while its time window is still open.
+//
+// Entries are kept in the order they are added. Each is remembered for the
+// longer of the TTL in force when it was added and the current one, so that
+// changing it with SetTTL never forgets randoms whose timestamps are still
+// within either skew. An entry is only dropped once those before it are, so
+// after a shortening some are kept longer than they need to be.
+// When the cache is full the oldest entry is dropped even if it hasn't expired.
+type ReplayCache struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	capacity int
+	seen     map[[32]byte]struct{}
+	queue    []replayEntry
+}
+
+// NewReplayCache returns a ReplayCache holding at most capacity randoms,
+// each forgotten ttl after it was added
+func NewReplayCache(capacity int, ttl time.Duration) *ReplayCache {
+	return &ReplayCache{
+		ttl:      ttl,
+		capacity: capacity,
+		seen:     make(map[[32]byte]struct{}),
+	}
+}
+
+// Add records random as seen at time now. It returns false if random has
+// been seen before and hasn't expired yet
+func (rc *ReplayCache) Add(random []byte, now time.Time) bool {
+	var key [32]byte
+	copy(key[:], random)
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	for len(rc.queue) > 0 {
+		oldest := rc.queue[0]
+		ttl := oldest.ttl
+		if rc.ttl > ttl {
+			ttl = rc.ttl
+		}
+		if now.Before(oldest.added.Add(ttl)) && len(rc.queue) < rc.capacity {
+			break
+		}
+		delete(rc.seen, oldest.random)
+		rc.queue = rc.queue[1:]
+	}
+
+	if _, ok := rc.seen[key]; ok {
+		return false
+	}
+	rc.seen[key] = struct{}{}
+	rc.queue = append(rc.queue, replayEntry{key, now, rc.ttl})
+	return true
+}
+
+// SetTTL changes how long randoms are remembered. A longer TTL applies to
+// those already added too, a shorter one only to those added from now on
+func (rc *ReplayCache) SetTTL(ttl time.Duration) {
+	rc.mutex.Lock()
+	rc.ttl = ttl
+	rc.mutex.Unlock()
+}
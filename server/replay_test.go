@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayShorterTTLKeepsOldRandoms(t *testing.T) {
+	start := time.Now()
+	rc := NewReplayCache(100, 10*time.Minute)
+	old := make([]byte, 32)
+	old[0] = 1
+	rc.Add(old, start)
+
+	// A reload with a smaller MaxSkew
+	rc.SetTTL(time.Minute)
+	fresh := make([]byte, 32)
+	fresh[0] = 2
+	rc.Add(fresh, start)
+
+	if rc.Add(old, start.Add(5*time.Minute)) {
+		t.Error("Random added under the old TTL was forgotten early")
+	}
+	if !rc.Add(old, start.Add(11*time.Minute)) {
+		t.Error("Random added under the old TTL was never forgotten")
+	}
+	if !rc.Add(fresh, start.Add(12*time.Minute)) {
+		t.Error("Random added under the new TTL was never forgotten")
+	}
+}
+
+func TestReplayLongerTTLExtendsOldRandoms(t *testing.T) {
+	start := time.Now()
+	rc := NewReplayCache(100, time.Minute)
+	old := make([]byte, 32)
+	old[0] = 1
+	rc.Add(old, start)
+
+	// A reload with a larger MaxSkew, whose timestamps old is still within
+	rc.SetTTL(10 * time.Minute)
+	if rc.Add(old, start.Add(5*time.Minute)) {
+		t.Error("Random added under the old TTL was forgotten before the new one")
+	}
+	if !rc.Add(old, start.Add(11*time.Minute)) {
+		t.Error("Random added under the old TTL was never forgotten")
+	}
+}
@@ -1,23 +1,81 @@
 package server
 
 import (
-	"crypto/sha256"
 	"time"
+
+	"github.com/cbeuw/masquerable/tunnel"
 )
 
 // State type stores the global state of the program
 type State struct {
 	RedirAddr  string
-	Key        string
-	AESKey     []byte
+	Users      []*User
 	Now        func() time.Time
 	MurmurAddr string
 	BindAddr   string
+	Replay     *ReplayCache
+	// KDFs are the ways of deriving keys, one of the kdf constants each,
+	// that clients may use. They are tried in order
+	KDFs []string
+	// KeySalt salts the keys derived by kdf.HKDF and kdf.Argon2id. Clients
+	// must have the same
+	KeySalt string
+	// DerivedKeys holds the keys derived for Users by DeriveKeys. Only the
+	// users whose keys are in it can authenticate
+	DerivedKeys *KeyCache
+	// Backends are the Murmur servers to choose from. If there are none
+	// MurmurAddr is used
+	Backends []*Backend
+	// DialTimeout is how long connecting to a backend, target or the web
+	// server may take
+	DialTimeout time.Duration
+	// HealthCheckInterval is how often each backend is connected to, to see
+	// if it's up
+	HealthCheckInterval time.Duration
+	// MaxSkew is how far the clock of a client may be from ours
+	MaxSkew time.Duration
+	// HandshakeTimeout is how long a client has to send each handshake message
+	HandshakeTimeout time.Duration
+	// DrainTimeout is how long established connections are given to close
+	// on their own after SIGTERM or SIGINT before they are cut
+	DrainTimeout time.Duration
+	// KeepAlive is how often multiplexed tunnels are pinged. One that has
+	// been silent for three times as long is closed
+	KeepAlive time.Duration
+	// Targets maps user names, or AllUsers, to host:port patterns of where
+	// their tunnels may ask to be forwarded to besides Murmur
+	Targets map[string][]string
+	// CloneServerName is the server name asked for when cloning the
+	// handshake of RedirAddr
+	CloneServerName string
+	// CloneInterval is how often the handshake of RedirAddr is cloned.
+	// 0 disables cloning
+	CloneInterval time.Duration
+	// Shapes are the handshakes cloned from RedirAddr. If nil, or before the
+	// first clone, a fixed handshake is used
+	Shapes *Shapes
+	// Padding is the policy records sent to mq-client are padded with,
+	// see tunnel.ParsePadding
+	Padding string
+	// Shaping is the profile of dummy records sent to mq-client during
+	// silence, see tunnel.Shaping. Empty or "none" disables shaping
+	Shaping string
+	// ShapingLatency is the most a write is held back when shaping
+	ShapingLatency time.Duration
+	// ShapingOverhead is how many bytes of dummy records may be sent a second
+	ShapingOverhead int
+	// MetricsAddr is where metrics are served. Empty to disable
+	MetricsAddr string
+	// Networks are the named ranges of client addresses used in metrics
+	Networks []Network
+	Verbose  bool
 }
 
-// SetAESKey calculates the SHA256 of the string key
-func (sta *State) SetAESKey() {
-	h := sha256.New()
-	h.Write([]byte(sta.Key))
-	sta.AESKey = h.Sum(nil)
+// TunnelShaping is how the tunnels are shaped
+func (sta *State) TunnelShaping() tunnel.Shaping {
+	return tunnel.Shaping{
+		Profile:     sta.Shaping,
+		Latency:     sta.ShapingLatency,
+		MaxOverhead: sta.ShapingOverhead,
+	}
 }
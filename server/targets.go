@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+
+	"github.com/cbeuw/masquerable/internal/dest"
+)
+
+// AllUsers is the name in State.Targets whose targets every user may reach
+const AllUsers = "*"
+
+// TargetAllowed checks if user may have their tunnel forwarded to target,
+// a host:port. The patterns in sta.Targets under the user's name and under
+// AllUsers are checked
+func (sta *State) TargetAllowed(user *User, target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	for _, name := range []string{user.Name, AllUsers} {
+		for _, pattern := range sta.Targets[name] {
+			if dest.Match(pattern, host, port) {
+				return true
+			}
+		}
+	}
+	return false
+}
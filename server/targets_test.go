@@ -0,0 +1,63 @@
+package server
+
+import "testing"
+
+func TestTargetAllowed(t *testing.T) {
+	sta := &State{
+		Targets: map[string][]string{
+			"alice":  {"*.example.com:443", "mumble.example.org:*", "[::1]:64738", "noport.example.net"},
+			"bob":    {"*:22"},
+			AllUsers: {"status.example.com:80"},
+		},
+	}
+	alice := &User{Name: "alice"}
+	bob := &User{Name: "bob"}
+	carol := &User{Name: "carol"}
+	cases := []struct {
+		user   *User
+		target string
+		want   bool
+	}{
+		{alice, "www.example.com:443", true},
+		{alice, "a.b.example.com:443", true},
+		// *.domain is only for subdomains
+		{alice, "example.com:443", false},
+		{alice, "evilexample.com:443", false},
+		{alice, "www.example.com.evil.net:443", false},
+		{alice, "www.example.com:80", false},
+		{alice, "WWW.Example.COM:443", true},
+		{alice, "mumble.example.org:1", true},
+		{alice, "mumble.example.org:64738", true},
+		{alice, "MUMBLE.EXAMPLE.ORG:64738", true},
+		{alice, "other.example.org:64738", false},
+		{alice, "[::1]:64738", true},
+		{alice, "[::1]:64739", false},
+		// Neither a target nor a pattern without a port matches anything
+		{alice, "www.example.com", false},
+		{alice, "noport.example.net:443", false},
+		{alice, "noport.example.net", false},
+		{bob, "anything.example:22", true},
+		{bob, "www.example.com:443", false},
+		// Everyone gets AllUsers' targets, and only their own on top
+		{alice, "status.example.com:80", true},
+		{bob, "status.example.com:80", true},
+		{carol, "status.example.com:80", true},
+		{carol, "www.example.com:443", false},
+		{carol, "status.example.com:443", false},
+	}
+	for _, c := range cases {
+		if got := sta.TargetAllowed(c.user, c.target); got != c.want {
+			t.Errorf("TargetAllowed(%v, %q) = %v, want %v", c.user.Name, c.target, got, c.want)
+		}
+	}
+}
+
+func TestTargetAllowedWithoutAllUsers(t *testing.T) {
+	sta := &State{Targets: map[string][]string{"alice": {"*:*"}}}
+	if !sta.TargetAllowed(&User{Name: "alice"}, "x.example:1") {
+		t.Error("*:* doesn't match everything")
+	}
+	if sta.TargetAllowed(&User{Name: "bob"}, "x.example:1") {
+		t.Error("User without targets got one")
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cbeuw/masquerable/kdf"
+)
+
+// User is someone allowed to use the server, identified by their own key
+type User struct {
+	Name string
+	Key  string
+}
+
+// NewUser makes a User
+func NewUser(name string, key string) *User {
+	return &User{
+		Name: name,
+		Key:  key,
+	}
+}
+
+type derivation struct {
+	key  string
+	kdf  string
+	salt string
+}
+
+// KeyCache holds the keys derived for users, so that they aren't derived
+// again for every ClientHello. Carrying it over to a new State means
+// reloading the users doesn't run Argon2id for all of them again
+type KeyCache struct {
+	mutex sync.Mutex
+	keys  map[derivation]*kdf.Keys
+}
+
+// NewKeyCache makes an empty KeyCache
+func NewKeyCache() *KeyCache {
+	return &KeyCache{keys: make(map[derivation]*kdf.Keys)}
+}
+
+// UserKeys returns the keys of user derived with kdfName and sta.KeySalt by
+// DeriveKeys. They are never derived here, as a ClientHello mustn't be able
+// to make the server run Argon2id
+func (sta *State) UserKeys(user *User, kdfName string) (*kdf.Keys, error) {
+	if sta.DerivedKeys != nil {
+		sta.DerivedKeys.mutex.Lock()
+		keys, ok := sta.DerivedKeys.keys[derivation{user.Key, kdfName, sta.KeySalt}]
+		sta.DerivedKeys.mutex.Unlock()
+		if ok {
+			return keys, nil
+		}
+	}
+	return nil, fmt.Errorf("Keys of %v with %v haven't been derived", user.Name, kdfName)
+}
+
+// DeriveKeys derives the keys of every user with every one of sta.KDFs into
+// sta.DerivedKeys, making a new KeyCache if there's none. Keys already in
+// it aren't derived again, and keys for users that are no longer in sta are
+// forgotten. If a KDF can't be used, the first error is returned after the
+// keys of the others are derived
+func (sta *State) DeriveKeys() error {
+	if sta.DerivedKeys == nil {
+		sta.DerivedKeys = NewKeyCache()
+	}
+	cache := sta.DerivedKeys
+	var firstErr error
+	used := make(map[derivation]*kdf.Keys)
+	for _, user := range sta.Users {
+		for _, kdfName := range sta.KDFs {
+			d := derivation{user.Key, kdfName, sta.KeySalt}
+			cache.mutex.Lock()
+			keys, ok := cache.keys[d]
+			cache.mutex.Unlock()
+			if !ok {
+				var err error
+				keys, err = kdf.Derive(user.Key, kdfName, sta.KeySalt)
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					continue
+				}
+			}
+			used[d] = keys
+		}
+	}
+	cache.mutex.Lock()
+	cache.keys = used
+	cache.mutex.Unlock()
+	return firstErr
+}
+
+// LoadUsers reads the user table from a file. Each line is name:key.
+// Empty lines and lines starting with # are ignored, so a user can be
+// revoked by deleting or commenting out their line
+func LoadUsers(path string) ([]*User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var users []*User
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v line %v: expecting name:key", path, lineNum)
+		}
+		name := strings.TrimSpace(fields[0])
+		key := strings.TrimSpace(fields[1])
+		if name == "" || key == "" {
+			return nil, fmt.Errorf("%v line %v: expecting name:key", path, lineNum)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("%v line %v: duplicate user %v", path, lineNum, name)
+		}
+		names[name] = true
+		users = append(users, NewUser(name, key))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, errors.New(path + ": no users")
+	}
+	return users, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cbeuw/masquerable/kdf"
+)
+
+func TestDeriveKeysCarriedOver(t *testing.T) {
+	alice := NewUser("alice", "correct horse")
+	bob := NewUser("bob", "battery staple")
+	old := &State{Users: []*User{alice, bob}, KDFs: []string{kdf.HKDF}, KeySalt: "salt"}
+	err := old.DeriveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceKeys, _ := old.UserKeys(alice, kdf.HKDF)
+	if _, err := old.UserKeys(bob, kdf.HKDF); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload without bob
+	sta := &State{Users: []*User{alice}, KDFs: []string{kdf.HKDF}, KeySalt: "salt", DerivedKeys: old.DerivedKeys}
+	err = sta.DeriveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := sta.UserKeys(alice, kdf.HKDF); keys != aliceKeys {
+		t.Error("Keys of alice were derived again")
+	}
+	if _, ok := sta.DerivedKeys.keys[derivation{bob.Key, kdf.HKDF, "salt"}]; ok {
+		t.Error("Keys of bob weren't forgotten")
+	}
+	if _, err := old.UserKeys(bob, kdf.HKDF); err == nil {
+		t.Error("Keys of bob are still cached")
+	}
+
+	// Other States have caches of their own
+	other := &State{Users: []*User{alice}, KDFs: []string{kdf.HKDF}, KeySalt: "salt"}
+	err = other.DeriveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := other.UserKeys(alice, kdf.HKDF); keys == aliceKeys {
+		t.Error("Keys of alice came from another State's cache")
+	}
+
+	// Keys are never derived on demand
+	notDerived := &State{Users: []*User{alice}, KDFs: []string{kdf.HKDF}, KeySalt: "salt"}
+	if _, err := notDerived.UserKeys(alice, kdf.HKDF); err == nil {
+		t.Error("Keys were derived by UserKeys")
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	cases := []struct {
+		name  string
+		file  string
+		want  []*User
+		valid bool
+	}{
+		{"users", "alice:correct horse\n# bob:old\n\n  bob : battery staple  \n", []*User{NewUser("alice", "correct horse"), NewUser("bob", "battery staple")}, true},
+		{"key with colons", "alice:a:b:c\n", []*User{NewUser("alice", "a:b:c")}, true},
+		{"no colon", "alice\n", nil, false},
+		{"empty key", "alice:\n", nil, false},
+		{"blank key", "alice:   \n", nil, false},
+		{"empty name", ":key\n", nil, false},
+		{"blank name", "  :key\n", nil, false},
+		{"duplicate", "alice:a\nalice:b\n", nil, false},
+		{"no users", "# nobody\n", nil, false},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "users")
+		err := os.WriteFile(path, []byte(c.file), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, err := LoadUsers(path)
+		if c.valid != (err == nil) {
+			t.Errorf("%v: got %v", c.name, err)
+			continue
+		}
+		if c.valid && !reflect.DeepEqual(users, c.want) {
+			t.Errorf("%v: got %v", c.name, users)
+		}
+	}
+}
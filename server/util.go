@@ -1,20 +1,19 @@
 package server
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"io"
-	prand "math/rand"
 	"net"
 	"strconv"
 	"time"
 )
 
-// PsudoRandBytes returns a byte slice filled with psudorandom bytes generated by the seed
-func PsudoRandBytes(length int, seed int64) []byte {
-	prand.Seed(seed)
+// CryptoRandBytes returns a byte slice filled with bytes from crypto/rand
+func CryptoRandBytes(length int) []byte {
 	ret := make([]byte, length)
-	prand.Read(ret)
+	rand.Read(ret)
 	return ret
 }
 
@@ -54,3 +53,71 @@ func ReadTLS(conn net.Conn, buffer []byte) (n int, err error) {
 	n = 5 + dataLength
 	return
 }
+
+// The largest ClientHello we are willing to reassemble. Anything bigger
+// can't be from mq-client
+const maxClientHelloLen = 1 << 16
+
+// ReadClientHello reads the handshake records carrying a ClientHello.
+// A ClientHello can arrive in several TCP segments, and it can be larger than
+// a record so that it is fragmented across several records. Records are read
+// according to their record layer until the entire handshake message is
+// in hand, and nothing after it is read.
+//
+// raw is every byte read from conn, so that it can be passed on to the web
+// server as is if the connection turns out not to be ours. It may be non-empty
+// even if err isn't nil. hello is the handshake message without record layers
+func ReadClientHello(conn net.Conn) (raw []byte, hello []byte, err error) {
+	header := make([]byte, 5)
+	// We don't know if this is TLS yet, so don't wait for an entire header
+	i, err := io.ReadAtLeast(conn, header, 1)
+	raw = append(raw, header[:i]...)
+	if err != nil {
+		return
+	}
+	if header[0] != 0x16 {
+		err = errors.New("Not a handshake record")
+		return
+	}
+	for {
+		var n int
+		n, err = io.ReadFull(conn, header[i:])
+		raw = append(raw, header[i:i+n]...)
+		if err != nil {
+			return
+		}
+		if header[0] != 0x16 || header[1] != 0x03 {
+			err = errors.New("Not a TLS handshake record")
+			return
+		}
+		dataLength := int(binary.BigEndian.Uint16(header[3:5]))
+		if dataLength == 0 || len(hello)+dataLength > maxClientHelloLen {
+			err = errors.New("Bad handshake record length: " + strconv.Itoa(dataLength))
+			return
+		}
+		fragment := make([]byte, dataLength)
+		n, err = io.ReadFull(conn, fragment)
+		raw = append(raw, fragment[:n]...)
+		if err != nil {
+			return
+		}
+		hello = append(hello, fragment...)
+
+		if len(hello) >= 4 {
+			helloLength := 4 + int(u32(append([]byte{0x00}, hello[1:4]...)))
+			if len(hello) == helloLength {
+				return
+			}
+			if len(hello) > helloLength {
+				err = errors.New("Handshake records longer than the ClientHello")
+				return
+			}
+			if helloLength > maxClientHelloLen {
+				err = errors.New("ClientHello too long: " + strconv.Itoa(helloLength))
+				return
+			}
+		}
+		// The ClientHello continues in the next record
+		i = 0
+	}
+}
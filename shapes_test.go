@@ -0,0 +1,192 @@
+package masquerable
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/masquerable/client"
+	"github.com/cbeuw/masquerable/kdf"
+	"github.com/cbeuw/masquerable/server"
+	"github.com/cbeuw/masquerable/tunnel"
+)
+
+// startWeb runs a crypto/tls server standing in for the web server whose
+// handshake is cloned
+func startWeb(t *testing.T, config *tls.Config) string {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Certificates = []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: priv}}
+	config.NextProtos = []string{"h2", "http/1.1"}
+	web, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { web.Close() })
+	go func() {
+		for {
+			conn, err := web.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return web.Addr().String()
+}
+
+// recordingConn keeps everything read from and written to a connection
+type recordingConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	read   []byte
+	writes [][]byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mutex.Lock()
+	c.read = append(c.read, b[:n]...)
+	c.mutex.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.writes = append(c.writes, append([]byte{}, b...))
+	c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestClonedHandshakeRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		tls13 bool
+		web   *tls.Config
+		// flights is how many the web server sends before the tunnel
+		flights int
+		// sentinel is the downgrade sentinel the web server's random ends in
+		sentinel []byte
+	}{
+		{"TLS 1.2 from a TLS 1.3 server", false, &tls.Config{}, 2, []byte("DOWNGRD\x01")},
+		{"TLS 1.2 without tickets", false, &tls.Config{MaxVersion: tls.VersionTLS12, SessionTicketsDisabled: true}, 2, nil},
+		{"TLS 1.3 without tickets", true, &tls.Config{SessionTicketsDisabled: true}, 1, nil},
+		// crypto/tls sends tickets with its Finished unless it asks for a
+		// client certificate. Then it waits for the client's Finished first,
+		// as OpenSSL always does
+		{"TLS 1.3 tickets in the first flight", true, &tls.Config{}, 1, nil},
+		{"TLS 1.3 tickets after the handshake", true, &tls.Config{ClientAuth: tls.RequestClientCert}, 2, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sta := &server.State{
+				RedirAddr:        startWeb(t, c.web),
+				CloneServerName:  "www.example.com",
+				Now:              time.Now,
+				Users:            []*server.User{server.NewUser("alice", "correct horse")},
+				KDFs:             []string{kdf.HKDF},
+				MaxSkew:          time.Minute,
+				HandshakeTimeout: 3 * time.Second,
+				DialTimeout:      3 * time.Second,
+				Shapes:           &server.Shapes{},
+			}
+			sta.Replay = server.NewReplayCache(1024, 2*sta.MaxSkew)
+			shape, err := server.CloneHandshake(sta.RedirAddr, sta.CloneServerName, c.tls13, sta.DialTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := shape.NumFlights(); got != c.flights {
+				t.Fatalf("Cloned %v flights, want %v", got, c.flights)
+			}
+			sta.Shapes.Set(shape)
+
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := Listen(inner, sta)
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+
+			conn, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			recorder := &recordingConn{Conn: conn}
+			remote, err := Client(recorder, &client.State{
+				Key:            "correct horse",
+				ServerName:     "www.example.com",
+				Browser:        "chrome",
+				TLS13:          c.tls13,
+				Now:            time.Now,
+				TicketTimeHint: 3600,
+			}, tunnel.KindTCP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent := make([]byte, 100000)
+			rand.Read(sent)
+			go remote.Write(sent)
+			got := make([]byte, len(sent))
+			_, err = io.ReadFull(remote, got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, sent) {
+				t.Fatal("Got something else back")
+			}
+
+			recorder.mutex.Lock()
+			defer recorder.mutex.Unlock()
+			// record layer, handshake header and version
+			random := recorder.read[5+4+2 : 5+4+2+32]
+			if c.sentinel != nil && !bytes.HasSuffix(random, c.sentinel) {
+				t.Errorf("Server random %x lost the downgrade sentinel", random)
+			}
+			if c.sentinel == nil && bytes.Contains(random, []byte("DOWNGRD")) {
+				t.Errorf("Server random %x has a downgrade sentinel", random)
+			}
+			// What follows the ClientHello
+			reply := recorder.writes[1]
+			isKeyExchange := reply[0] == 0x16 && reply[5] == 0x10
+			if c.tls13 && isKeyExchange {
+				t.Error("ClientKeyExchange sent in a TLS 1.3 handshake")
+			}
+			if !c.tls13 && !isKeyExchange {
+				t.Errorf("TLS 1.2 handshake answered with a record of type %v", reply[0])
+			}
+		})
+	}
+}
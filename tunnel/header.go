@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The first byte mq-client sends through a tunnel tells mq-server what the
+// tunnel carries
+const (
+	// KindTCP tunnels carry the Mumble control channel as a byte stream
+	KindTCP byte = 0x00
+	// KindUDP tunnels carry Mumble voice datagrams, framed by WriteDatagram
+	KindUDP byte = 0x01
+	// KindMux tunnels carry many streams, see package mux
+	KindMux byte = 0x02
+	// KindTarget tunnels carry a byte stream to a host:port of the client's
+	// choosing, written by WriteTarget right after the kind
+	KindTarget byte = 0x03
+)
+
+var errBadKind = errors.New("Tunnel: unknown kind of stream")
+var errDatagramTooLong = errors.New("Tunnel: datagram longer than buffer")
+var errTargetTooLong = errors.New("Tunnel: target longer than 255 bytes")
+
+// WriteHeader tells the other end what kind of stream follows
+func WriteHeader(w io.Writer, kind byte) error {
+	_, err := w.Write([]byte{kind})
+	return err
+}
+
+// ReadHeader reads the kind of stream written by WriteHeader
+func ReadHeader(r io.Reader) (kind byte, err error) {
+	b := make([]byte, 1)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return
+	}
+	kind = b[0]
+	if kind > KindTarget {
+		err = errBadKind
+	}
+	return
+}
+
+// WriteTarget tells the other end of a KindTarget stream where to forward it to
+func WriteTarget(w io.Writer, target string) error {
+	if len(target) > 255 {
+		return errTargetTooLong
+	}
+	_, err := w.Write(append([]byte{byte(len(target))}, target...))
+	return err
+}
+
+// ReadTarget reads the host:port written by WriteTarget
+func ReadTarget(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	_, err := io.ReadFull(r, length)
+	if err != nil {
+		return "", err
+	}
+	target := make([]byte, length[0])
+	_, err = io.ReadFull(r, target)
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// WriteDatagram writes a datagram prefixed by its 2 byte length, so that
+// datagram boundaries survive the byte stream
+func WriteDatagram(w io.Writer, b []byte) error {
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame[0:2], uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a single datagram written by WriteDatagram into buf
+func ReadDatagram(r io.Reader, buf []byte) (n int, err error) {
+	lenBytes := make([]byte, 2)
+	_, err = io.ReadFull(r, lenBytes)
+	if err != nil {
+		return
+	}
+	n = int(binary.BigEndian.Uint16(lenBytes))
+	if n > len(buf) {
+		return 0, errDatagramTooLong
+	}
+	return io.ReadFull(r, buf[:n])
+}
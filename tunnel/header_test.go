@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTargetRoundTrip(t *testing.T) {
+	cases := []struct {
+		target string
+		ok     bool
+	}{
+		{"", true},
+		{"www.example.com:443", true},
+		{"[::1]:64738", true},
+		{strings.Repeat("a", 250) + ":4430", true},
+		{strings.Repeat("a", 251) + ":4430", false},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		err := WriteTarget(&buf, c.target)
+		if !c.ok {
+			if err != errTargetTooLong {
+				t.Errorf("Target of %v bytes: got %v", len(c.target), err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("Target of %v bytes: %v bytes written anyway", len(c.target), buf.Len())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Target of %v bytes: %v", len(c.target), err)
+			continue
+		}
+		// What follows the target must be left alone
+		buf.WriteString("rest")
+		got, err := ReadTarget(&buf)
+		if err != nil || got != c.target {
+			t.Errorf("Read back %q, %v from %q", got, err, c.target)
+		}
+		if buf.String() != "rest" {
+			t.Errorf("ReadTarget of %q left %q", c.target, buf.String())
+		}
+	}
+}
+
+func TestReadTargetTruncated(t *testing.T) {
+	for _, b := range [][]byte{{}, {5, 'a', 'b'}} {
+		_, err := ReadTarget(bytes.NewReader(b))
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Errorf("ReadTarget(%v) returned %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// The padding policies ParsePadding knows
+const (
+	// PadNone sends records as long as the data they carry
+	PadNone = "none"
+	// PadBuckets rounds records up to the next power of two from 128 bytes
+	PadBuckets = "buckets"
+	// PadFixed makes every record the same size, 1400 bytes unless given
+	// after a colon like "fixed:1200". Longer writes are split
+	PadFixed = "fixed"
+	// PadHTTPS picks record sizes the way they turn up in HTTPS browsing
+	PadHTTPS = "https"
+)
+
+// Every record's plaintext starts with the 2 byte length of the data it
+// carries, the rest is padding
+const lengthLen = 2
+
+// The largest amount of data one record can carry
+const maxData = maxPlaintext - lengthLen
+
+const defaultFixedSize = 1400
+const minFixedSize = 64
+
+// Padding gives how long the plaintext of a record carrying n bytes of data
+// should be, counting the length in front of the data. If that's too short
+// for n bytes, the record carries as much as fits and the rest goes in
+// records of their own
+type Padding func(n int) int
+
+func noPadding(n int) int {
+	return lengthLen + n
+}
+
+func bucketPadding(n int) int {
+	size := 128
+	for size < lengthLen+n {
+		size *= 2
+	}
+	if size > maxPlaintext {
+		return maxPlaintext
+	}
+	return size
+}
+
+func fixedPadding(size int) Padding {
+	return func(n int) int {
+		return size
+	}
+}
+
+// httpsSizes are plaintext sizes of the application_data records of HTTPS
+// page loads, up to and including size, and how often they turn up in 100
+// records. It's coarse, it only needs to look like browsing rather than
+// like any particular site
+var httpsSizes = []struct {
+	size   int
+	weight int
+}{
+	{40, 7},
+	{100, 9},
+	{200, 5},
+	{400, 6},
+	{700, 4},
+	{1100, 4},
+	{1400, 11},
+	{3000, 4},
+	{6000, 4},
+	{12000, 5},
+	{16383, 11},
+	{16384, 30},
+}
+
+// httpsPadding picks a size among the ones in httpsSizes that are long
+// enough for n bytes, weighted by how often they turn up
+func httpsPadding(n int) int {
+	need := lengthLen + n
+	total := 0
+	for _, s := range httpsSizes {
+		if s.size >= need {
+			total += s.weight
+		}
+	}
+	pick := rand.Intn(total)
+	low := 1
+	for _, s := range httpsSizes {
+		if s.size >= need {
+			if pick < s.weight {
+				if low < need {
+					low = need
+				}
+				return low + rand.Intn(s.size-low+1)
+			}
+			pick -= s.weight
+		}
+		low = s.size + 1
+	}
+	return maxPlaintext
+}
+
+// ParsePadding gives the Padding of a policy, one of the Pad constants.
+// An empty policy is PadNone
+func ParsePadding(policy string) (Padding, error) {
+	name, arg, hasArg := strings.Cut(policy, ":")
+	if hasArg && name != PadFixed {
+		return nil, fmt.Errorf("Padding %v takes no size", name)
+	}
+	switch name {
+	case "", PadNone:
+		return noPadding, nil
+	case PadBuckets:
+		return bucketPadding, nil
+	case PadHTTPS:
+		return httpsPadding, nil
+	case PadFixed:
+		if !hasArg {
+			return fixedPadding(defaultFixedSize), nil
+		}
+		size, err := strconv.Atoi(arg)
+		if err != nil || size < minFixedSize || size > maxPlaintext {
+			return nil, fmt.Errorf("Padding size must be between %v and %v", minFixedSize, maxPlaintext)
+		}
+		return fixedPadding(size), nil
+	}
+	return nil, fmt.Errorf("Unknown padding %v", policy)
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// recordLens splits what was written into records and gives their lengths
+func recordLens(t *testing.T, written []byte) []int {
+	var lens []int
+	for len(written) > 0 {
+		if len(written) < 5 {
+			t.Fatal("Record header cut short")
+		}
+		length := int(binary.BigEndian.Uint16(written[3:5]))
+		lens = append(lens, length)
+		written = written[5+length:]
+	}
+	return lens
+}
+
+func TestPaddingRoundTrip(t *testing.T) {
+	policies := []string{PadNone, PadBuckets, PadFixed, PadFixed + ":64", PadHTTPS}
+	sizes := []int{1, 100, 1398, 1399, 5000, maxData, maxData + 1, 100000}
+	key := make([]byte, 32)
+	random := make([]byte, 32)
+	for _, policy := range policies {
+		padding, err := ParsePadding(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range sizes {
+			c, s := net.Pipe()
+			client := Client(c, key, random)
+			client.SetPadding(padding)
+			server := Server(s, key, random)
+
+			sent := make([]byte, size)
+			rand.Read(sent)
+			go func() {
+				client.Write(sent)
+				c.Close()
+			}()
+			got, err := io.ReadAll(server)
+			if err != nil {
+				t.Fatalf("%v, %v bytes: %v", policy, size, err)
+			}
+			if !bytes.Equal(got, sent) {
+				t.Fatalf("%v, %v bytes: got something else back", policy, size)
+			}
+		}
+	}
+}
+
+func TestPaddingSizes(t *testing.T) {
+	key := make([]byte, 32)
+	random := make([]byte, 32)
+	cases := []struct {
+		policy string
+		size   int
+		want   []int
+	}{
+		{PadNone, 10, []int{2 + 10 + 16}},
+		{PadBuckets, 10, []int{128 + 16}},
+		{PadBuckets, 200, []int{256 + 16}},
+		{PadFixed, 10, []int{1400 + 16}},
+		{PadFixed, 3000, []int{1400 + 16, 1400 + 16, 1400 + 16}},
+	}
+	for _, c := range cases {
+		padding, err := ParsePadding(c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written bytes.Buffer
+		conn := Client(&bufConn{written: &written}, key, random)
+		conn.SetPadding(padding)
+		conn.Write(make([]byte, c.size))
+		lens := recordLens(t, written.Bytes())
+		if len(lens) != len(c.want) {
+			t.Fatalf("%v, %v bytes: records of %v, want %v", c.policy, c.size, lens, c.want)
+		}
+		for i := range lens {
+			if lens[i] != c.want[i] {
+				t.Fatalf("%v, %v bytes: records of %v, want %v", c.policy, c.size, lens, c.want)
+			}
+		}
+	}
+}
+
+func TestParsePaddingErrors(t *testing.T) {
+	for _, policy := range []string{"padded", "fixed:", "fixed:10", "fixed:20000", "buckets:128"} {
+		if _, err := ParsePadding(policy); err == nil {
+			t.Errorf("%q was accepted", policy)
+		}
+	}
+}
+
+// bufConn is a net.Conn that only collects what is written to it
+type bufConn struct {
+	net.Conn
+	written *bytes.Buffer
+}
+
+func (c *bufConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
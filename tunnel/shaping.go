@@ -0,0 +1,258 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// The shaping profiles, how often dummy records are sent when there's
+// nothing else to send
+const (
+	// ShapeNone sends every write straight away and nothing else
+	ShapeNone = "none"
+	// ShapeBrowsing sends a burst of dummy records after about a second of
+	// silence, like the page loads of someone browsing
+	ShapeBrowsing = "browsing"
+	// ShapeSparse is like ShapeBrowsing but with about ten seconds between
+	// bursts, for less overhead
+	ShapeSparse = "sparse"
+)
+
+type profile struct {
+	// meanGap is the mean silence before a burst
+	meanGap time.Duration
+	// maxBurst is the most dummy records in a burst
+	maxBurst int
+}
+
+var profiles = map[string]profile{
+	ShapeBrowsing: {time.Second, 8},
+	ShapeSparse:   {10 * time.Second, 3},
+}
+
+// Shaping is how the writes to a Conn are timed
+type Shaping struct {
+	// Profile is one of the Shape constants. Empty is ShapeNone
+	Profile string
+	// Latency is the most a write is held back so that it can go out
+	// together with the writes after it
+	Latency time.Duration
+	// MaxOverhead is how many bytes of dummy records may be sent a second
+	MaxOverhead int
+}
+
+// Validate checks that shaping makes sense
+func (shaping Shaping) Validate() error {
+	if shaping.Profile != "" && shaping.Profile != ShapeNone {
+		if _, ok := profiles[shaping.Profile]; !ok {
+			return fmt.Errorf("Unknown shaping profile %v", shaping.Profile)
+		}
+	}
+	if shaping.Latency < 0 {
+		return errors.New("Shaping latency must not be negative")
+	}
+	if shaping.MaxOverhead < 0 {
+		return errors.New("Shaping overhead must not be negative")
+	}
+	return nil
+}
+
+// How much a shaped Conn holds before Write blocks
+const maxPending = 4 * maxData
+
+// How long Close waits for what's held to be sent
+const closeTimeout = time.Second
+
+// shaper holds the writes to a Conn and sends them, and dummy records, from
+// a goroutine of its own
+type shaper struct {
+	conn     *Conn
+	profile  profile
+	latency  time.Duration
+	overhead int
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	err     error
+
+	// tokens is how many bytes of dummy records can be sent now
+	tokens float64
+	filled time.Time
+
+	wake    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newShaper(conn *Conn, shaping Shaping) *shaper {
+	s := &shaper{
+		conn:     conn,
+		profile:  profiles[shaping.Profile],
+		latency:  shaping.Latency,
+		overhead: shaping.MaxOverhead,
+		filled:   time.Now(),
+		wake:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	go s.run()
+	return s
+}
+
+// write holds on to b until the next flush. It only blocks when a lot is
+// held already
+func (s *shaper) write(b []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.err == nil && len(s.pending) >= maxPending {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.pending = append(s.pending, b...)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (s *shaper) hasPending() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.pending) > 0
+}
+
+func (s *shaper) fail(err error) {
+	s.mutex.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.pending = nil
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+}
+
+// flush sends everything held
+func (s *shaper) flush() bool {
+	s.mutex.Lock()
+	data := s.pending
+	s.pending = nil
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	if len(data) == 0 {
+		return true
+	}
+	_, err := s.conn.writeData(data)
+	if err != nil {
+		s.fail(err)
+		return false
+	}
+	return true
+}
+
+// hold waits a random time within the latency budget for more writes to
+// batch, unless enough is held to fill a record already
+func (s *shaper) hold() bool {
+	s.mutex.Lock()
+	full := len(s.pending) >= maxData
+	s.mutex.Unlock()
+	if full || s.latency <= 0 {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(s.latency) + 1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.closing:
+		return false
+	}
+}
+
+// gap is how long to wait for the next burst
+func (s *shaper) gap() time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(s.profile.meanGap))
+}
+
+// burst sends dummy records, stopping as soon as there is real data to send
+// or the overhead allowance runs out
+func (s *shaper) burst() bool {
+	now := time.Now()
+	s.tokens += now.Sub(s.filled).Seconds() * float64(s.overhead)
+	if s.tokens > float64(s.overhead) {
+		s.tokens = float64(s.overhead)
+	}
+	s.filled = now
+
+	count := 1 + rand.Intn(s.profile.maxBurst)
+	for i := 0; i < count && !s.hasPending(); i++ {
+		// Dummy records are padded like the others, so that their sizes
+		// don't give them away. They aren't cut down to fit the allowance
+		// for the same reason
+		size := s.conn.padding(0)
+		if size < lengthLen+1 {
+			size = lengthLen + 1
+		}
+		if size > maxPlaintext {
+			size = maxPlaintext
+		}
+		if float64(size) > s.tokens {
+			break
+		}
+		s.tokens -= float64(size)
+		err := s.conn.writeRecord(nil, size)
+		if err != nil {
+			s.fail(err)
+			return false
+		}
+	}
+	return true
+}
+
+func (s *shaper) run() {
+	defer close(s.done)
+	idle := time.NewTimer(s.gap())
+	defer idle.Stop()
+	for {
+		select {
+		case <-s.wake:
+			if !s.hold() || !s.flush() {
+				return
+			}
+			// Only silence is covered up
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(s.gap())
+		case <-idle.C:
+			if !s.burst() {
+				return
+			}
+			idle.Reset(s.gap())
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// close stops the goroutine and sends whatever is still held
+func (s *shaper) close() {
+	s.once.Do(func() {
+		close(s.closing)
+		<-s.done
+		s.flush()
+		s.fail(net.ErrClosed)
+	})
+}
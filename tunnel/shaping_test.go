@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shapedPair is a shaped Client and the Server reading from it
+func shapedPair(t *testing.T, shaping Shaping) (*Conn, *Conn) {
+	c, s := net.Pipe()
+	key := make([]byte, 32)
+	random := make([]byte, 32)
+	client := Client(c, key, random)
+	err := client.SetShaping(shaping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := Server(s, key, random)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestShapingRoundTrip(t *testing.T) {
+	client, server := shapedPair(t, Shaping{ShapeBrowsing, 5 * time.Millisecond, 1 << 20})
+	sent := make([]byte, 300000)
+	rand.Read(sent)
+	go func() {
+		// Many small writes, to be batched
+		for b := sent; len(b) > 0; {
+			n := 1 + len(b)%700
+			if n > len(b) {
+				n = len(b)
+			}
+			client.Write(b[:n])
+			b = b[n:]
+		}
+		client.Close()
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Fatal("Got something else back")
+	}
+}
+
+func TestShapingLatency(t *testing.T) {
+	latency := 20 * time.Millisecond
+	client, server := shapedPair(t, Shaping{ShapeBrowsing, latency, 0})
+	buf := make([]byte, 100)
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		client.Write([]byte("voice"))
+		_, err := io.ReadFull(server, buf[:5])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Loose, the scheduler can be slow under -race
+		if elapsed := time.Since(start); elapsed > latency+50*time.Millisecond {
+			t.Fatalf("Write held back for %v, budget is %v", elapsed, latency)
+		}
+	}
+}
+
+// countingConn counts the bytes written to it and throws them away
+type countingConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	written int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.written += len(b)
+	c.mutex.Unlock()
+	return len(b), nil
+}
+
+func (c *countingConn) Close() error {
+	return nil
+}
+
+func (c *countingConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestShapingOverhead(t *testing.T) {
+	// Bursts often enough that the allowance is what limits them
+	profiles["test"] = profile{10 * time.Millisecond, 8}
+	defer delete(profiles, "test")
+	counter := &countingConn{}
+	conn := Client(counter, make([]byte, 32), make([]byte, 32))
+	// Dummy records are padded like the others
+	size := 1000
+	conn.SetPadding(fixedPadding(size))
+	overhead := 20000
+	conn.SetShaping(Shaping{"test", time.Millisecond, overhead})
+	period := time.Second
+	time.Sleep(period)
+	conn.Close()
+
+	counter.mutex.Lock()
+	written := counter.written
+	counter.mutex.Unlock()
+	if written%(5+size+16) != 0 {
+		t.Fatalf("%v bytes of dummy records aren't all %v byte records", written, 5+size+16)
+	}
+	if written < overhead/2 {
+		t.Fatalf("Only %v bytes of dummy records during %v of silence", written, period)
+	}
+	// The allowance starts empty and fills up at overhead a second. Every
+	// dummy record adds a header and the AEAD tag to what it was charged,
+	// and one more record is slack for the time Close takes
+	record := 5 + size + 16
+	limit := int(period.Seconds()*float64(overhead))/size*record + record
+	if written > limit {
+		t.Fatalf("%v bytes of dummy records in %v, allowed %v a second", written, period, overhead)
+	}
+}
+
+func TestShapingCloseFlushes(t *testing.T) {
+	client, server := shapedPair(t, Shaping{ShapeSparse, time.Hour, 0})
+	client.Write([]byte("held"))
+	go client.Close()
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "held" {
+		t.Fatalf("Got %q", got)
+	}
+}
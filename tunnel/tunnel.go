@@ -0,0 +1,219 @@
+// Package tunnel carries the Mumble stream inside TLS application_data records
+// whose payloads are sealed with AES-GCM
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// The largest plaintext a TLS record may carry
+const maxPlaintext = 16384
+
+// A sealed record can be at most this long, same as TLS 1.2 with AEAD
+const maxRecordLen = maxPlaintext + 256
+
+var errBadRecordType = errors.New("Tunnel: record is not application_data")
+var errRecordTooLong = errors.New("Tunnel: record length greater than allowed")
+var errOpen = errors.New("Tunnel: record authentication failed")
+var errBadLength = errors.New("Tunnel: data length greater than record")
+
+// Conn is a net.Conn whose Read and Write go through sealed records
+type Conn struct {
+	net.Conn
+
+	sealer cipher.AEAD
+	opener cipher.AEAD
+
+	// Each direction has its own key, so counters never collide
+	writeCtr uint64
+	readCtr  uint64
+
+	padding Padding
+	shaper  *shaper
+
+	readBuf  []byte
+	leftover []byte
+}
+
+// deriveKey derives a direction specific session key from the shared key and
+// the random field of the ClientHello
+func deriveKey(key []byte, random []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(random)
+	return mac.Sum(nil)
+}
+
+func makeAEAD(key []byte) cipher.AEAD {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+func newConn(conn net.Conn, key []byte, random []byte, isClient bool) *Conn {
+	c2s := makeAEAD(deriveKey(key, random, "masquerable client to server"))
+	s2c := makeAEAD(deriveKey(key, random, "masquerable server to client"))
+	ret := &Conn{
+		Conn:    conn,
+		readBuf: make([]byte, 5+maxRecordLen),
+		padding: noPadding,
+	}
+	if isClient {
+		ret.sealer, ret.opener = c2s, s2c
+	} else {
+		ret.sealer, ret.opener = s2c, c2s
+	}
+	return ret
+}
+
+// Client wraps the connection to mq-server. key is the payload key of the client
+// and random is the random field of the ClientHello it sent
+func Client(conn net.Conn, key []byte, random []byte) *Conn {
+	return newConn(conn, key, random, true)
+}
+
+// Server wraps the connection from mq-client. key is the payload key the ClientHello
+// authenticated with and random is the random field of that ClientHello
+func Server(conn net.Conn, key []byte, random []byte) *Conn {
+	return newConn(conn, key, random, false)
+}
+
+// The nonce is the record counter. An out of order or replayed record gets
+// the wrong nonce and fails authentication
+func makeNonce(ctr uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], ctr)
+	return nonce
+}
+
+// SetPadding changes how long the records written from now on are. The
+// other end strips the padding whatever it is. nil is no padding. It must
+// not be called concurrently with Write
+func (c *Conn) SetPadding(padding Padding) {
+	if padding == nil {
+		padding = noPadding
+	}
+	c.padding = padding
+}
+
+// SetShaping makes the writes from now on go out as shaping says. It must
+// be called at most once, and not concurrently with Write
+func (c *Conn) SetShaping(shaping Shaping) error {
+	err := shaping.Validate()
+	if err != nil {
+		return err
+	}
+	if shaping.Profile == "" || shaping.Profile == ShapeNone {
+		return nil
+	}
+	c.shaper = newShaper(c, shaping)
+	return nil
+}
+
+// writeRecord seals data, padded to size, into an application_data record
+func (c *Conn) writeRecord(data []byte, size int) error {
+	plaintext := make([]byte, size)
+	binary.BigEndian.PutUint16(plaintext[0:2], uint16(len(data)))
+	copy(plaintext[lengthLen:], data)
+	rec := make([]byte, 5, 5+len(plaintext)+c.sealer.Overhead())
+	rec[0], rec[1], rec[2] = 0x17, 0x03, 0x03
+	rec = c.sealer.Seal(rec, makeNonce(c.writeCtr), plaintext, nil)
+	c.writeCtr++
+	binary.BigEndian.PutUint16(rec[3:5], uint16(len(rec)-5))
+	_, err := c.Conn.Write(rec)
+	return err
+}
+
+// Write seals b into one or more application_data records, padded as
+// set by SetPadding. If shaping is set, b is held back and sent later,
+// so write errors show up on a later Write
+func (c *Conn) Write(b []byte) (n int, err error) {
+	if c.shaper != nil {
+		return c.shaper.write(b)
+	}
+	return c.writeData(b)
+}
+
+func (c *Conn) writeData(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxData {
+			chunk = chunk[:maxData]
+		}
+		size := c.padding(len(chunk))
+		// Every record carries at least a byte, whatever the padding says
+		if size < lengthLen+1 {
+			size = lengthLen + 1
+		}
+		if size > maxPlaintext {
+			size = maxPlaintext
+		}
+		if size < lengthLen+len(chunk) {
+			chunk = chunk[:size-lengthLen]
+		}
+		err = c.writeRecord(chunk, size)
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return
+}
+
+// Close closes the connection, first sending whatever shaping held back
+// if that can be done quickly
+func (c *Conn) Close() error {
+	if c.shaper != nil {
+		c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.shaper.close()
+	}
+	return c.Conn.Close()
+}
+
+// Read reads and opens records until one carries data, when there is
+// nothing left from the previous one. Any record that fails to open is an
+// error and the connection should be closed
+func (c *Conn) Read(b []byte) (n int, err error) {
+	for len(c.leftover) == 0 {
+		_, err = io.ReadFull(c.Conn, c.readBuf[:5])
+		if err != nil {
+			return
+		}
+		if c.readBuf[0] != 0x17 {
+			return 0, errBadRecordType
+		}
+		dataLength := int(binary.BigEndian.Uint16(c.readBuf[3:5]))
+		if dataLength > maxRecordLen {
+			return 0, errRecordTooLong
+		}
+		_, err = io.ReadFull(c.Conn, c.readBuf[5:5+dataLength])
+		if err != nil {
+			return
+		}
+		plaintext, err := c.opener.Open(c.readBuf[5:5], makeNonce(c.readCtr), c.readBuf[5:5+dataLength], nil)
+		if err != nil {
+			return 0, errOpen
+		}
+		c.readCtr++
+		if len(plaintext) < lengthLen {
+			return 0, errBadLength
+		}
+		carried := int(binary.BigEndian.Uint16(plaintext[0:2]))
+		if carried > len(plaintext)-lengthLen {
+			return 0, errBadLength
+		}
+		c.leftover = plaintext[lengthLen : lengthLen+carried]
+	}
+	n = copy(b, c.leftover)
+	c.leftover = c.leftover[n:]
+	return
+}